@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACME challenge types accepted by "acme.challenge"
+const (
+	ACMEChallengeHTTP01    = "http-01"
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// ACME defaults
+const (
+	defaultACMEDirectory   = "https://acme-v02.api.letsencrypt.org/directory"
+	defaultACMEStorageDir  = "acme"
+	defaultACMERenewBefore = 30 * 24 * time.Hour
+	acmeCheckInterval      = time.Hour
+	acmePollTimeout        = 5 * time.Minute
+	acmeTLSALPNProtocol    = "acme-tls/1"
+	acmeBadNonce           = "urn:ietf:params:acme:error:badNonce"
+)
+
+// oidACMEIdentifier is the id-pe-acmeIdentifier certificate extension (RFC 8737)
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+/*
+ * @ ACMEManager obtains and renews certificates from an RFC 8555 CA
+ * such as Let's Encrypt. Challenges are answered by FluxLB's own
+ * listeners: http-01 on the HTTP port and tls-alpn-01 on the HTTPS
+ * port. Issued certificates are written to the storage directory,
+ * which the certificate store serves from
+ */
+type ACMEManager struct {
+	config      ACMEConfig
+	storage     string
+	renewBefore time.Duration
+	store       *CertStore
+	client      *http.Client
+
+	// Account state, used by one issuance at a time
+	key       *ecdsa.PrivateKey
+	directory *acmeDirectory
+	kid       string
+	nonce     string
+
+	// Pending challenge responses
+	mu         sync.RWMutex
+	tokens     map[string]string
+	challenges map[string]*tls.Certificate
+}
+
+// acmeDirectory lists the CA's endpoints
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeOrder is a request for a certificate
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+// acmeAuthorization is the CA's record of proving control of an identifier
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeChallenge is one way of proving control of an identifier
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeProblem is an RFC 7807 problem document returned by the CA
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return p.Type + ": " + p.Detail
+}
+
+// acmeStorageDir returns where account keys and certificates are kept
+func acmeStorageDir(config ACMEConfig) string {
+	if config.StorageDir == "" {
+		return defaultACMEStorageDir
+	}
+	return config.StorageDir
+}
+
+// NewACMEManager validates the ACME settings and loads or creates the
+// account key. Issued certificates are handed to store.
+func NewACMEManager(config ACMEConfig, store *CertStore) (*ACMEManager, error) {
+	if len(config.Domains) == 0 {
+		return nil, fmt.Errorf("acme: no domains configured")
+	}
+	for _, domain := range config.Domains {
+		if strings.HasPrefix(domain, "*.") {
+			return nil, fmt.Errorf("acme: wildcard %s needs a dns-01 challenge, which is not supported", domain)
+		}
+	}
+	switch config.Challenge {
+	case "":
+		config.Challenge = ACMEChallengeHTTP01
+	case ACMEChallengeHTTP01, ACMEChallengeTLSALPN01:
+	default:
+		return nil, fmt.Errorf("acme: unknown challenge type: %s", config.Challenge)
+	}
+	if config.DirectoryURL == "" {
+		config.DirectoryURL = defaultACMEDirectory
+	}
+
+	m := &ACMEManager{
+		config:      config,
+		storage:     acmeStorageDir(config),
+		renewBefore: time.Duration(config.RenewBefore) * 24 * time.Hour,
+		store:       store,
+		tokens:      make(map[string]string),
+		challenges:  make(map[string]*tls.Certificate),
+	}
+	if m.renewBefore <= 0 {
+		m.renewBefore = defaultACMERenewBefore
+	}
+
+	// A private CA, such as a local Pebble test server, needs its own root
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CAFile != "" {
+		roots, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	m.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+
+	if err := os.MkdirAll(m.storage, 0700); err != nil {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	key, err := loadOrCreateKey(filepath.Join(m.storage, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("acme: account key: %w", err)
+	}
+	m.key = key
+	return m, nil
+}
+
+// Run issues missing certificates and renews expiring ones until ctx is
+// cancelled. Failures are retried at the next check.
+func (m *ACMEManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(acmeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.renewAll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// renewAll obtains a certificate for every domain that needs one
+func (m *ACMEManager) renewAll(ctx context.Context) {
+	issued := false
+	for _, domain := range m.config.Domains {
+		if !m.needsRenewal(domain) {
+			continue
+		}
+		log.Printf("ACME: requesting certificate for %s", domain)
+		if err := m.obtain(ctx, domain); err != nil {
+			log.Printf("ACME: certificate for %s failed: %v", domain, err)
+			continue
+		}
+		log.Printf("ACME: obtained certificate for %s", domain)
+		issued = true
+	}
+
+	if issued {
+		if err := m.store.Reload(); err != nil {
+			log.Printf("Certificate reload failed, keeping previous certificates: %v", err)
+		}
+	}
+}
+
+// needsRenewal reports whether the stored certificate for the domain is
+// missing, unreadable, does not match its key or is close to expiry
+func (m *ACMEManager) needsRenewal(domain string) bool {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(m.storage, domain+".crt"), filepath.Join(m.storage, domain+".key"))
+	if err != nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Until(cert.NotAfter) < m.renewBefore
+}
+
+// obtain runs one order for the domain and stores the issued certificate
+func (m *ACMEManager) obtain(ctx context.Context, domain string) error {
+	if err := m.register(ctx); err != nil {
+		return err
+	}
+
+	var order acmeOrder
+	resp, err := m.post(ctx, m.directory.NewOrder, map[string]any{
+		"identifiers": []map[string]string{{"type": "dns", "value": domain}},
+	}, &order)
+	if err != nil {
+		return fmt.Errorf("new order: %w", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authz := range order.Authorizations {
+		if err := m.authorize(ctx, authz); err != nil {
+			return err
+		}
+	}
+
+	if err := m.poll(ctx, orderURL, &order, func() bool { return order.Status != "pending" }); err != nil {
+		return err
+	}
+	if order.Status != "ready" {
+		return fmt.Errorf("order is %s: %v", order.Status, order.Error)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return err
+	}
+	if _, err := m.post(ctx, order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order); err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	if err := m.poll(ctx, orderURL, &order, func() bool { return order.Status != "processing" }); err != nil {
+		return err
+	}
+	if order.Status != "valid" {
+		return fmt.Errorf("order is %s: %v", order.Status, order.Error)
+	}
+
+	resp, err = m.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return fmt.Errorf("download certificate: %w", err)
+	}
+	chain, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return m.storeCertificate(domain, chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// storeCertificate replaces the domain's certificate and key. Both are
+// written to temporary files first and then renamed in quick succession,
+// so the certificate store's poller is unlikely to see a mismatched pair.
+// If it does, the reload fails and is retried; if FluxLB stops between
+// the renames, needsRenewal notices the mismatch and reissues.
+func (m *ACMEManager) storeCertificate(domain string, chain, key []byte) error {
+	certFile := filepath.Join(m.storage, domain+".crt")
+	keyFile := filepath.Join(m.storage, domain+".key")
+
+	certTmp, err := stageFile(certFile, chain)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(certTmp)
+	keyTmp, err := stageFile(keyFile, key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyTmp)
+
+	if err := os.Rename(certTmp, certFile); err != nil {
+		return err
+	}
+	return os.Rename(keyTmp, keyFile)
+}
+
+// register creates the account, or looks up the existing account for
+// the key, on first use
+func (m *ACMEManager) register(ctx context.Context) error {
+	if m.kid != "" {
+		return nil
+	}
+	if m.directory == nil {
+		resp, err := m.client.Get(m.config.DirectoryURL)
+		if err != nil {
+			return fmt.Errorf("directory: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("directory: unexpected status %d", resp.StatusCode)
+		}
+		var directory acmeDirectory
+		if err := json.NewDecoder(resp.Body).Decode(&directory); err != nil {
+			return fmt.Errorf("directory: %w", err)
+		}
+		m.directory = &directory
+	}
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if m.config.Email != "" {
+		account["contact"] = []string{"mailto:" + m.config.Email}
+	}
+	resp, err := m.post(ctx, m.directory.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("account: %w", err)
+	}
+	resp.Body.Close()
+	m.kid = resp.Header.Get("Location")
+	if m.kid == "" {
+		return fmt.Errorf("account: no account URL returned")
+	}
+	return nil
+}
+
+// authorize proves control of an authorization's identifier with the
+// configured challenge type
+func (m *ACMEManager) authorize(ctx context.Context, url string) error {
+	var authz acmeAuthorization
+	if _, err := m.post(ctx, url, nil, &authz); err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	i := slices.IndexFunc(authz.Challenges, func(c acmeChallenge) bool { return c.Type == m.config.Challenge })
+	if i < 0 {
+		return fmt.Errorf("%s: CA does not offer %s", authz.Identifier.Value, m.config.Challenge)
+	}
+	challenge := authz.Challenges[i]
+
+	keyAuth, err := m.keyAuthorization(challenge.Token)
+	if err != nil {
+		return err
+	}
+	domain := strings.ToLower(authz.Identifier.Value)
+	cleanup, err := m.provision(domain, challenge, keyAuth)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	resp, err := m.post(ctx, challenge.URL, struct{}{}, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %s challenge: %w", domain, challenge.Type, err)
+	}
+	resp.Body.Close()
+	if err := m.poll(ctx, url, &authz, func() bool { return authz.Status != "pending" }); err != nil {
+		return err
+	}
+	if authz.Status != "valid" {
+		for _, c := range authz.Challenges {
+			if c.Error != nil {
+				return fmt.Errorf("%s: %s challenge failed: %v", domain, c.Type, c.Error)
+			}
+		}
+		return fmt.Errorf("%s: authorization is %s", domain, authz.Status)
+	}
+	return nil
+}
+
+// provision makes the listeners answer a challenge until cleanup is called
+func (m *ACMEManager) provision(domain string, challenge acmeChallenge, keyAuth string) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch challenge.Type {
+	case ACMEChallengeHTTP01:
+		m.tokens[challenge.Token] = keyAuth
+		return func() {
+			m.mu.Lock()
+			delete(m.tokens, challenge.Token)
+			m.mu.Unlock()
+		}, nil
+	default:
+		cert, err := tlsALPNCertificate(domain, keyAuth)
+		if err != nil {
+			return nil, err
+		}
+		m.challenges[domain] = cert
+		return func() {
+			m.mu.Lock()
+			delete(m.challenges, domain)
+			m.mu.Unlock()
+		}, nil
+	}
+}
+
+// ChallengeHandler answers http-01 challenges. Unknown tokens are passed
+// on to next, so ACME clients behind FluxLB keep working.
+func (m *ACMEManager) ChallengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[token]
+		m.mu.RUnlock()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, keyAuth)
+	})
+}
+
+// GetConfigForClient answers tls-alpn-01 challenges. Other handshakes
+// keep the listener's configuration.
+func (m *ACMEManager) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if !slices.Contains(hello.SupportedProtos, acmeTLSALPNProtocol) {
+		return nil, nil
+	}
+	m.mu.RLock()
+	cert := m.challenges[strings.ToLower(hello.ServerName)]
+	m.mu.RUnlock()
+	if cert == nil {
+		return nil, fmt.Errorf("no pending tls-alpn-01 challenge for %q", hello.ServerName)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{acmeTLSALPNProtocol},
+	}, nil
+}
+
+// tlsALPNCertificate builds the self-signed certificate that proves
+// control of a domain for tls-alpn-01
+func tlsALPNCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidACMEIdentifier, Critical: true, Value: value}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// post sends a JWS-signed request. A nil payload makes it a POST-as-GET.
+// When out is set the JSON response is decoded into it and the body
+// closed; otherwise the caller reads and closes it.
+func (m *ACMEManager) post(ctx context.Context, url string, payload any, out any) (*http.Response, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	// A rejected nonce is not a failure of the request itself
+	for attempt := 1; ; attempt++ {
+		resp, err := m.send(ctx, url, body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{}
+			json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(problem)
+			resp.Body.Close()
+			if problem.Type == acmeBadNonce && attempt < 3 {
+				continue
+			}
+			if problem.Type == "" {
+				problem.Type = "status " + strconv.Itoa(resp.StatusCode)
+			}
+			return nil, problem
+		}
+		if out != nil {
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+}
+
+// send signs the body with the account key and posts it
+func (m *ACMEManager) send(ctx context.Context, url string, payload []byte) (*http.Response, error) {
+	if m.nonce == "" {
+		if err := m.fetchNonce(ctx); err != nil {
+			return nil, err
+		}
+	}
+	jws, err := m.sign(url, payload)
+	if err != nil {
+		return nil, err
+	}
+	m.nonce = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	m.nonce = resp.Header.Get("Replay-Nonce")
+	return resp, nil
+}
+
+// fetchNonce gets a fresh anti-replay nonce
+func (m *ACMEManager) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, m.directory.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("nonce: %w", err)
+	}
+	resp.Body.Close()
+	m.nonce = resp.Header.Get("Replay-Nonce")
+	if m.nonce == "" {
+		return fmt.Errorf("nonce: no Replay-Nonce header")
+	}
+	return nil
+}
+
+// sign builds a flattened JWS signed with ES256. Requests before the
+// account exists carry the public key, later ones the account URL.
+func (m *ACMEManager) sign(url string, payload []byte) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": m.nonce, "url": url}
+	if m.kid != "" {
+		protected["kid"] = m.kid
+	} else {
+		jwk, err := m.jwk()
+		if err != nil {
+			return nil, err
+		}
+		protected["jwk"] = json.RawMessage(jwk)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, m.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// ES256 signatures are the fixed-size concatenation of r and s
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// jwk returns the account public key as a JSON Web Key with its members
+// in the lexicographic order required for thumbprints (RFC 7638)
+func (m *ACMEManager) jwk() ([]byte, error) {
+	point, err := m.key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	x := base64.RawURLEncoding.EncodeToString(point[1:33])
+	y := base64.RawURLEncoding.EncodeToString(point[33:])
+	return []byte(`{"crv":"P-256","kty":"EC","x":"` + x + `","y":"` + y + `"}`), nil
+}
+
+// keyAuthorization binds a challenge token to the account key
+func (m *ACMEManager) keyAuthorization(token string) (string, error) {
+	jwk, err := m.jwk()
+	if err != nil {
+		return "", err
+	}
+	thumbprint := sha256.Sum256(jwk)
+	return token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:]), nil
+}
+
+// poll re-fetches a resource until done reports true, honouring the
+// CA's Retry-After hint
+func (m *ACMEManager) poll(ctx context.Context, url string, out any, done func() bool) error {
+	ctx, cancel := context.WithTimeout(ctx, acmePollTimeout)
+	defer cancel()
+
+	for !done() {
+		delay := time.Second
+		resp, err := m.post(ctx, url, nil, out)
+		if err != nil {
+			return err
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+		if done() {
+			return nil
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errors.New("timed out waiting for the CA")
+		}
+	}
+	return nil
+}
+
+// loadOrCreateKey reads a PEM EC private key, generating one if the
+// file does not exist
+func loadOrCreateKey(file string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in %s", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeFileAtomic replaces a file so readers never see partial content
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := stageFile(file, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, file)
+}
+
+// stageFile writes data to a new temporary file next to file, ready to
+// be renamed over it, and returns the temporary file's name
+func stageFile(file string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
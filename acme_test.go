@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * @ fakeACME is a minimal RFC 8555 CA for tests. It verifies every JWS,
+ * tracks nonces, validates challenges by calling the manager's own
+ * responders and issues certificates from a test CA
+ */
+type fakeACME struct {
+	t       *testing.T
+	ca      *testCA
+	server  *httptest.Server
+	manager *ACMEManager
+
+	mu           sync.Mutex
+	nonces       map[string]bool
+	nextNonce    int
+	rejectNonces int // badNonce answers still to give
+	badNonces    int // badNonce answers given
+	accountKey   *ecdsa.PublicKey
+	domain       string
+	token        string
+	authzValid   bool
+	chain        []byte
+	requests     []string
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	f := &fakeACME{t: t, ca: newTestCA(t), nonces: make(map[string]bool), token: "token-123"}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeACME) url(path string) string {
+	return f.server.URL + path
+}
+
+func (f *fakeACME) newNonce() string {
+	f.nextNonce++
+	nonce := "nonce-" + strconv.Itoa(f.nextNonce)
+	f.nonces[nonce] = true
+	return nonce
+}
+
+func (f *fakeACME) problem(w http.ResponseWriter, status int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(acmeProblem{Type: kind, Detail: detail})
+}
+
+func (f *fakeACME) reply(w http.ResponseWriter, status int, location string, body any) {
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/directory":
+		f.reply(w, http.StatusOK, "", acmeDirectory{
+			NewNonce:   f.url("/new-nonce"),
+			NewAccount: f.url("/new-account"),
+			NewOrder:   f.url("/new-order"),
+		})
+		return
+	case r.URL.Path == "/new-nonce":
+		w.Header().Set("Replay-Nonce", f.newNonce())
+		return
+	case r.Method != http.MethodPost:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := f.verify(r)
+	w.Header().Set("Replay-Nonce", f.newNonce())
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "bad nonce") {
+			f.badNonces++
+			f.problem(w, http.StatusBadRequest, acmeBadNonce, err.Error())
+			return
+		}
+		f.t.Errorf("%s: %v", r.URL.Path, err)
+		f.problem(w, http.StatusBadRequest, "urn:ietf:params:acme:error:malformed", err.Error())
+		return
+	}
+	f.requests = append(f.requests, r.URL.Path)
+
+	switch r.URL.Path {
+	case "/new-account":
+		f.reply(w, http.StatusCreated, f.url("/account/1"), map[string]string{"status": "valid"})
+	case "/new-order":
+		var order struct {
+			Identifiers []struct{ Type, Value string }
+		}
+		json.Unmarshal(payload, &order)
+		if len(order.Identifiers) != 1 || order.Identifiers[0].Type != "dns" {
+			f.t.Errorf("unexpected identifiers: %s", payload)
+		}
+		f.domain = order.Identifiers[0].Value
+		f.reply(w, http.StatusCreated, f.url("/order/1"), f.order())
+	case "/order/1":
+		f.reply(w, http.StatusOK, "", f.order())
+	case "/authz/1":
+		f.reply(w, http.StatusOK, "", f.authorization())
+	case "/challenge/http-01", "/challenge/tls-alpn-01":
+		f.authzValid = f.validate(strings.TrimPrefix(r.URL.Path, "/challenge/"))
+		f.reply(w, http.StatusOK, "", map[string]string{"status": "processing"})
+	case "/finalize/1":
+		if !f.authzValid {
+			f.problem(w, http.StatusForbidden, "urn:ietf:params:acme:error:orderNotReady", "not ready")
+			return
+		}
+		var finalize struct{ CSR string }
+		json.Unmarshal(payload, &finalize)
+		f.chain = f.issue(finalize.CSR)
+		// Issuance is reported as processing first, like a real CA
+		order := f.order()
+		order.Status = "processing"
+		order.Certificate = ""
+		f.reply(w, http.StatusOK, "", order)
+	case "/certificate/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeACME) order() acmeOrder {
+	order := acmeOrder{
+		Status:         "pending",
+		Authorizations: []string{f.url("/authz/1")},
+		Finalize:       f.url("/finalize/1"),
+	}
+	switch {
+	case f.chain != nil:
+		order.Status = "valid"
+		order.Certificate = f.url("/certificate/1")
+	case f.authzValid:
+		order.Status = "ready"
+	}
+	return order
+}
+
+func (f *fakeACME) authorization() acmeAuthorization {
+	authz := acmeAuthorization{Status: "pending"}
+	if f.authzValid {
+		authz.Status = "valid"
+	}
+	authz.Identifier.Value = f.domain
+	for _, kind := range []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+		authz.Challenges = append(authz.Challenges, acmeChallenge{
+			Type:   kind,
+			URL:    f.url("/challenge/" + kind),
+			Token:  f.token,
+			Status: authz.Status,
+		})
+	}
+	return authz
+}
+
+// keyAuthorization computes the expected key authorization from the
+// account key the CA registered
+func (f *fakeACME) keyAuthorization() string {
+	point, _ := f.accountKey.Bytes()
+	jwk := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(point[1:33]), base64.RawURLEncoding.EncodeToString(point[33:]))
+	thumbprint := sha256.Sum256([]byte(jwk))
+	return f.token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
+
+// validate checks the challenge response the way a CA would, through
+// the manager's HTTP handler or TLS configuration
+func (f *fakeACME) validate(kind string) bool {
+	switch kind {
+	case ACMEChallengeHTTP01:
+		handler := f.manager.ChallengeHandler(http.NotFoundHandler())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://"+f.domain+acmeChallengePath+f.token, nil))
+		return w.Code == http.StatusOK && w.Body.String() == f.keyAuthorization()
+	default:
+		config, err := f.manager.GetConfigForClient(&tls.ClientHelloInfo{
+			ServerName:      f.domain,
+			SupportedProtos: []string{acmeTLSALPNProtocol},
+		})
+		if err != nil || config == nil || !slices.Equal(config.NextProtos, []string{acmeTLSALPNProtocol}) {
+			return false
+		}
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil || !slices.Equal(leaf.DNSNames, []string{f.domain}) {
+			return false
+		}
+		digest := sha256.Sum256([]byte(f.keyAuthorization()))
+		want, _ := asn1.Marshal(digest[:])
+		for _, ext := range leaf.Extensions {
+			if ext.Id.Equal(oidACMEIdentifier) {
+				return ext.Critical && string(ext.Value) == string(want)
+			}
+		}
+		return false
+	}
+}
+
+func (f *fakeACME) issue(encodedCSR string) []byte {
+	der, err := base64.RawURLEncoding.DecodeString(encodedCSR)
+	if err != nil {
+		f.t.Errorf("csr encoding: %v", err)
+		return nil
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || csr.CheckSignature() != nil {
+		f.t.Errorf("invalid csr: %v", err)
+		return nil
+	}
+	if !slices.Equal(csr.DNSNames, []string{f.domain}) {
+		f.t.Errorf("csr names = %v, want %s", csr.DNSNames, f.domain)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, f.ca.cert, csr.PublicKey, f.ca.key)
+	if err != nil {
+		f.t.Error(err)
+		return nil
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), f.ca.pem...)
+}
+
+// verify checks the JWS of a request and returns its payload
+func (f *fakeACME) verify(r *http.Request) ([]byte, error) {
+	if r.Header.Get("Content-Type") != "application/jose+json" {
+		return nil, fmt.Errorf("content type %q", r.Header.Get("Content-Type"))
+	}
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *struct{ Crv, Kty, X, Y string }
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, err
+	}
+
+	if !f.nonces[header.Nonce] {
+		return nil, fmt.Errorf("bad nonce %q", header.Nonce)
+	}
+	delete(f.nonces, header.Nonce)
+	if f.rejectNonces > 0 {
+		f.rejectNonces--
+		return nil, fmt.Errorf("bad nonce %q (injected)", header.Nonce)
+	}
+	if header.Alg != "ES256" {
+		return nil, fmt.Errorf("alg %q", header.Alg)
+	}
+	if header.URL != f.url(r.URL.Path) {
+		return nil, fmt.Errorf("url %q signed for %q", header.URL, r.URL.Path)
+	}
+
+	var key *ecdsa.PublicKey
+	switch {
+	case r.URL.Path == "/new-account":
+		if header.JWK == nil || header.Kid != "" {
+			return nil, fmt.Errorf("new account must be signed with a jwk")
+		}
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		f.accountKey = key
+	case header.Kid == f.url("/account/1") && header.JWK == nil:
+		key = f.accountKey
+	default:
+		return nil, fmt.Errorf("request must be signed with the account url")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(signature) != 64 {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	rInt, sInt := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], rInt, sInt) {
+		return nil, fmt.Errorf("signature does not verify")
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
+
+func TestACMEObtain(t *testing.T) {
+	for _, challenge := range []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+		t.Run(challenge, func(t *testing.T) {
+			ca := newFakeACME(t)
+			storage := t.TempDir()
+			manager, err := NewACMEManager(ACMEConfig{
+				DirectoryURL: ca.url("/directory"),
+				Domains:      []string{"shop.example.com"},
+				Challenge:    challenge,
+				StorageDir:   storage,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ca.manager = manager
+
+			if !manager.needsRenewal("shop.example.com") {
+				t.Fatal("missing certificate does not need renewal")
+			}
+			if err := manager.register(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			// The new order is refused with badNonce and must be retried
+			ca.mu.Lock()
+			ca.rejectNonces = 1
+			ca.mu.Unlock()
+
+			if err := manager.obtain(context.Background(), "shop.example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			ca.mu.Lock()
+			defer ca.mu.Unlock()
+			if ca.badNonces != 1 {
+				t.Errorf("%d badNonce rejections, want 1", ca.badNonces)
+			}
+			want := []string{"/new-account", "/new-order", "/authz/1", "/challenge/" + challenge, "/authz/1", "/order/1", "/finalize/1", "/order/1", "/certificate/1"}
+			if !slices.Equal(ca.requests, want) {
+				t.Errorf("requests = %v, want %v", ca.requests, want)
+			}
+
+			pair, err := tls.LoadX509KeyPair(filepath.Join(storage, "shop.example.com.crt"), filepath.Join(storage, "shop.example.com.key"))
+			if err != nil {
+				t.Fatalf("stored pair: %v", err)
+			}
+			if !slices.Equal(pair.Leaf.DNSNames, []string{"shop.example.com"}) {
+				t.Errorf("certificate names = %v", pair.Leaf.DNSNames)
+			}
+			if manager.needsRenewal("shop.example.com") {
+				t.Error("fresh certificate needs renewal")
+			}
+
+			// Challenge responses are withdrawn once the order is done
+			if _, err := manager.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "shop.example.com", SupportedProtos: []string{acmeTLSALPNProtocol}}); err == nil {
+				t.Error("tls-alpn-01 challenge still answered after the order")
+			}
+			manager.mu.RLock()
+			tokens := len(manager.tokens)
+			manager.mu.RUnlock()
+			if tokens != 0 {
+				t.Error("http-01 token still served after the order")
+			}
+
+			entries, _ := os.ReadDir(storage)
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), ".tmp-") {
+					t.Errorf("temporary file %s left behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestACMENeedsRenewal(t *testing.T) {
+	ca := newTestCA(t)
+	storage := t.TempDir()
+	manager, err := NewACMEManager(ACMEConfig{Domains: []string{"a.example.com"}, StorageDir: storage, RenewBefore: 30}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, certPEM, keyPEM := ca.issue(t, "a.example.com", "a.example.com")
+	_, _, otherKey := ca.issue(t, "a.example.com", "a.example.com")
+	tests := []struct {
+		name string
+		cert []byte
+		key  []byte
+		want bool
+	}{
+		{name: "matching pair expiring within renew_before", cert: certPEM, key: keyPEM, want: true},
+		{name: "key from another issuance", cert: certPEM, key: otherKey, want: true},
+		{name: "garbage certificate", cert: []byte("not pem"), key: keyPEM, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeTestFile(t, storage, "a.example.com.crt", tt.cert)
+			writeTestFile(t, storage, "a.example.com.key", tt.key)
+			if got := manager.needsRenewal("a.example.com"); got != tt.want {
+				t.Errorf("needsRenewal = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Test certificates are valid for an hour, so only a short renewal
+	// window leaves them alone
+	manager.renewBefore = time.Minute
+	writeTestFile(t, storage, "a.example.com.crt", certPEM)
+	writeTestFile(t, storage, "a.example.com.key", keyPEM)
+	if manager.needsRenewal("a.example.com") {
+		t.Error("valid certificate outside the renewal window needs renewal")
+	}
+}
+
+func TestACMEChallengeResponders(t *testing.T) {
+	manager, err := NewACMEManager(ACMEConfig{Domains: []string{"a.example.com"}, StorageDir: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	})
+	handler := manager.ChallengeHandler(next)
+
+	serve := func(token string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://a.example.com"+acmeChallengePath+token, nil))
+		return w.Body.String()
+	}
+	if got := serve("tok"); got != "backend" {
+		t.Errorf("unknown token answered with %q, want it passed on", got)
+	}
+
+	cleanup, err := manager.provision("a.example.com", acmeChallenge{Type: ACMEChallengeHTTP01, Token: "tok"}, "tok.thumb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serve("tok"); got != "tok.thumb" {
+		t.Errorf("provisioned token answered with %q", got)
+	}
+	cleanup()
+	if got := serve("tok"); got != "backend" {
+		t.Errorf("token still answered after cleanup: %q", got)
+	}
+
+	// Ordinary handshakes keep the listener configuration
+	config, err := manager.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "a.example.com", SupportedProtos: []string{"h2", "http/1.1"}})
+	if config != nil || err != nil {
+		t.Errorf("ordinary handshake got %v, %v", config, err)
+	}
+	if _, err := manager.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "a.example.com", SupportedProtos: []string{acmeTLSALPNProtocol}}); err == nil {
+		t.Error("acme-tls/1 handshake without a pending challenge succeeded")
+	}
+
+	cleanup, err = manager.provision("a.example.com", acmeChallenge{Type: ACMEChallengeTLSALPN01, Token: "tok"}, "tok.thumb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	config, err = manager.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "A.Example.com", SupportedProtos: []string{acmeTLSALPNProtocol}})
+	if err != nil || config == nil {
+		t.Fatalf("pending challenge not answered: %v", err)
+	}
+	if !slices.Equal(config.NextProtos, []string{acmeTLSALPNProtocol}) {
+		t.Errorf("next protos = %v", config.NextProtos)
+	}
+}
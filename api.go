@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"net/url"
 )
@@ -10,13 +11,15 @@ import (
 type APIHandler struct {
 	lb          *LoadBalancer
 	authManager *AuthManager
+	state       *StateStore
 }
 
 // NewAPIHandler creates a new API handler
-func NewAPIHandler(lb *LoadBalancer, authManager *AuthManager) *APIHandler {
+func NewAPIHandler(lb *LoadBalancer, authManager *AuthManager, state *StateStore) *APIHandler {
 	return &APIHandler{
 		lb:          lb,
 		authManager: authManager,
+		state:       state,
 	}
 }
 
@@ -35,7 +38,10 @@ type LoginResponse struct {
 
 // BackendRequest represents a backend add/remove request
 type BackendRequest struct {
-	URL string `json:"url"`
+	Pool        string             `json:"pool,omitempty"`
+	URL         string             `json:"url"`
+	Weight      int                `json:"weight,omitempty"`
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
 }
 
 // Response represents a generic API response
@@ -158,7 +164,16 @@ func (api *APIHandler) HandleAddBackend(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := api.lb.AddBackend(req.URL); err != nil {
+	if req.Pool == "" {
+		req.Pool = DefaultPool
+	}
+
+	bc := BackendConfig{URL: req.URL, Weight: req.Weight, HealthCheck: req.HealthCheck}
+	pool, err := api.lb.GetPool(req.Pool)
+	if err == nil {
+		err = pool.AddBackend(bc)
+	}
+	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(Response{
@@ -168,6 +183,12 @@ func (api *APIHandler) HandleAddBackend(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// The backend is live either way; report that it will not survive a restart
+	if err := api.state.Added(pool, bc); err != nil {
+		api.stateError(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(Response{
 		Success: true,
@@ -193,7 +214,15 @@ func (api *APIHandler) HandleRemoveBackend(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := api.lb.RemoveBackend(req.URL); err != nil {
+	if req.Pool == "" {
+		req.Pool = DefaultPool
+	}
+
+	pool, err := api.lb.GetPool(req.Pool)
+	if err == nil {
+		err = pool.RemoveBackend(req.URL)
+	}
+	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Response{
@@ -203,6 +232,11 @@ func (api *APIHandler) HandleRemoveBackend(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if err := api.state.Removed(pool, req.URL); err != nil {
+		api.stateError(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(Response{
 		Success: true,
@@ -210,6 +244,18 @@ func (api *APIHandler) HandleRemoveBackend(w http.ResponseWriter, r *http.Reques
 	})
 }
 
+// stateError reports a backend change that was applied but could not be
+// written to the state file
+func (api *APIHandler) stateError(w http.ResponseWriter, err error) {
+	log.Printf("Failed to save state: %v", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: "Change applied but not saved to the state file: " + err.Error(),
+	})
+}
+
 // HandleGetBackends handles getting all backends
 func (api *APIHandler) HandleGetBackends(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -217,7 +263,24 @@ func (api *APIHandler) HandleGetBackends(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	backends := api.lb.GetBackends()
+	// Optionally restrict the listing to a single pool
+	var backends []*Backend
+	if name := r.URL.Query().Get("pool"); name != "" {
+		pool, err := api.lb.GetPool(name)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+		backends = pool.GetBackends()
+	} else {
+		backends = api.lb.GetBackends()
+	}
+
 	urls := make([]string, len(backends))
 	for i, backend := range backends {
 		urls[i] = backend.URL.String()
@@ -226,3 +289,14 @@ func (api *APIHandler) HandleGetBackends(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(urls)
 }
+
+// HandleGetConnections handles listing active layer-4 connections
+func (api *APIHandler) HandleGetConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.lb.GetConnections())
+}
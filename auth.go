@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"log"
 	"net/http"
 	"strings"
 	"sync"
@@ -36,13 +37,37 @@ func NewAuthManager(config *AuthConfig) *AuthManager {
 	return am
 }
 
+// settings returns the current authentication configuration
+func (am *AuthManager) settings() AuthConfig {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return *am.config
+}
+
+// Update applies reloaded authentication settings. Changed credentials
+// end all existing sessions.
+func (am *AuthManager) Update(config AuthConfig) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if config == *am.config {
+		return
+	}
+	if config.Username != am.config.Username || config.Password != am.config.Password {
+		am.sessions = make(map[string]*Session)
+	}
+	*am.config = config
+	log.Printf("Authentication settings updated (enabled: %v)", config.Enabled)
+}
+
 // Login authenticates a user and creates a session
 func (am *AuthManager) Login(username, password string) (string, error) {
-	if !am.config.Enabled {
+	config := am.settings()
+	if !config.Enabled {
 		return "", nil
 	}
 
-	if username != am.config.Username || password != am.config.Password {
+	if username != config.Username || password != config.Password {
 		return "", http.ErrAbortHandler
 	}
 
@@ -69,7 +94,7 @@ func (am *AuthManager) Logout(token string) {
 
 // ValidateSession checks if a session token is valid
 func (am *AuthManager) ValidateSession(token string) bool {
-	if !am.config.Enabled {
+	if !am.settings().Enabled {
 		return true
 	}
 
@@ -87,7 +112,7 @@ func (am *AuthManager) ValidateSession(token string) bool {
 // AuthMiddleware is a middleware that requires authentication
 func (am *AuthManager) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !am.config.Enabled {
+		if !am.settings().Enabled {
 			next(w, r)
 			return
 		}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
+	"math"
 	"net/http/httputil"
 	"net/url"
 	"sync"
@@ -30,8 +33,48 @@ type Backend struct {
 
 	// Time quanta for scheduling (average processing time)
 	TimeQuanta time.Duration
+
+	// Relative share of traffic and smooth weighted round-robin state
+	Weight        int
+	currentWeight int64
+
+	// Peak-EWMA latency for power-of-two-choices scheduling
+	PeakEWMA  time.Duration
+	ewmaStamp time.Time
+
+	// Passive health state maintained by the outlier detector
+	EjectedUntil      time.Time
+	Ejections         int64
+	consecutiveErrors int
+	ejectionLevel     uint
+
+	// Requests that failed on this backend and were retried elsewhere
+	Retries int64
+
+	// Bytes relayed by layer-4 connections, counted when they close
+	BytesIn  int64
+	BytesOut int64
+
+	// Optional circuit breaker, nil when disabled
+	breaker *CircuitBreaker
+
+	// Active health check definition, the per-backend overrides it was
+	// built from, and rise/fall counters
+	healthCheck     *HealthCheck
+	healthOverride  *HealthCheckConfig
+	healthSuccesses int
+	healthFailures  int
+
+	// PROXY protocol version sent when dialing, empty when disabled
+	proxyProtocol string
+
+	// TLS settings for https backends, nil for the defaults
+	tlsConfig *tls.Config
 }
 
+// peakEWMADecay is the time constant over which latency spikes are forgotten
+const peakEWMADecay = 10 * time.Second
+
 /*
  * @ Represents the metrics of a backend server
  * for monitoring purposes
@@ -39,31 +82,68 @@ type Backend struct {
  * average latency, and uptime
  */
 type BackendMetrics struct {
-	URL               string        `json:"url"`
-	Alive             bool          `json:"alive"`
-	RequestCount      int64         `json:"request_count"`
-	AvgLatency        time.Duration `json:"avg_latency_ns"`
-	Uptime            time.Duration `json:"uptime_ns"`
-	ActiveConnections int64         `json:"active_connections"`
-	RequestsPerSec    float64       `json:"requests_per_sec"`
-	TimeQuanta        time.Duration `json:"time_quanta_ns"`
+	URL               string          `json:"url"`
+	Pool              string          `json:"pool"`
+	Alive             bool            `json:"alive"`
+	RequestCount      int64           `json:"request_count"`
+	AvgLatency        time.Duration   `json:"avg_latency_ns"`
+	Uptime            time.Duration   `json:"uptime_ns"`
+	ActiveConnections int64           `json:"active_connections"`
+	RequestsPerSec    float64         `json:"requests_per_sec"`
+	TimeQuanta        time.Duration   `json:"time_quanta_ns"`
+	Weight            int             `json:"weight"`
+	PeakEWMA          time.Duration   `json:"peak_ewma_ns"`
+	Ejected           bool            `json:"ejected"`
+	EjectedUntil      *time.Time      `json:"ejected_until,omitempty"`
+	Ejections         int64           `json:"ejections"`
+	ConsecutiveErrors int             `json:"consecutive_errors"`
+	Retries           int64           `json:"retries"`
+	BytesIn           int64           `json:"bytes_in"`
+	BytesOut          int64           `json:"bytes_out"`
+	Circuit           *CircuitMetrics `json:"circuit,omitempty"`
 }
 
 /*
  		* @ Creates a new Backend instance
-   			* with the given URL string
+   			* from the given backend configuration
       		* and initializes its reverse proxy
 */
-func NewBackend(urlStr string) (*Backend, error) {
-	url, err := url.Parse(urlStr)
+func NewBackend(bc BackendConfig) (*Backend, error) {
+	url, err := url.Parse(bc.URL)
 	if err != nil {
 		return nil, err
 	}
+
+	// A missing weight means an equal share
+	weight := bc.Weight
+	if weight < 0 {
+		return nil, fmt.Errorf("invalid weight %d", weight)
+	}
+	if weight == 0 {
+		weight = 1
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(url)
+			pr.Out.Host = pr.In.Host
+			rewriteForwarded(pr)
+
+			// Header rules run last so they can override forwarding headers
+			if attempt := attemptFrom(pr.In.Context()); attempt != nil && attempt.headers != nil {
+				attempt.headers.Request(pr.Out)
+			}
+		},
+		ModifyResponse: proxyModifyResponse,
+		ErrorHandler:   proxyErrorHandler,
+	}
+
 	return &Backend{
 		URL:          url,
 		Alive:        true,
-		ReverseProxy: httputil.NewSingleHostReverseProxy(url),
+		ReverseProxy: proxy,
 		StartTime:    time.Now(),
+		Weight:       weight,
 	}, nil
 }
 
@@ -83,6 +163,54 @@ func (b *Backend) IsAlive() bool {
 	return b.Alive
 }
 
+// ReportHealth records an active health check result. The backend only
+// changes state after Rise consecutive successes or Fall consecutive failures.
+func (b *Backend) ReportHealth(healthy bool) (changed bool, alive bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if healthy {
+		b.healthFailures = 0
+		b.healthSuccesses++
+		if !b.Alive && b.healthSuccesses >= b.healthCheck.Rise {
+			b.Alive = true
+			changed = true
+		}
+	} else {
+		b.healthSuccesses = 0
+		b.healthFailures++
+		if b.Alive && b.healthFailures >= b.healthCheck.Fall {
+			b.Alive = false
+			changed = true
+		}
+	}
+	return changed, b.Alive
+}
+
+// IsEjected reports whether the outlier detector has taken the backend out of rotation
+func (b *Backend) IsEjected() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return time.Now().Before(b.EjectedUntil)
+}
+
+// IsAvailable reports whether the backend may be picked by the scheduler
+func (b *Backend) IsAvailable() bool {
+	b.mu.RLock()
+	available := b.Alive && !time.Now().Before(b.EjectedUntil)
+	b.mu.RUnlock()
+	return available && (b.breaker == nil || b.breaker.Ready())
+}
+
+// Admit asks the circuit breaker, if any, to let a scheduled request
+// through and returns the breaker generation to record its outcome in
+func (b *Backend) Admit() (uint64, bool) {
+	if b.breaker == nil {
+		return 0, true
+	}
+	return b.breaker.Acquire()
+}
+
 /*
  * @ Updates the backend's metrics
  * Add request increments the request count and latency
@@ -103,6 +231,31 @@ func (b *Backend) AddRequest(latency time.Duration) {
 		// EMA with alpha = 0.3
 		b.TimeQuanta = time.Duration(float64(b.TimeQuanta)*0.7 + float64(latency)*0.3)
 	}
+
+	// Peak EWMA: jump to latency spikes immediately, decay towards
+	// lower latencies with a weight based on the time since the last sample
+	now := b.LastRequestTime
+	if latency > b.PeakEWMA {
+		b.PeakEWMA = latency
+	} else {
+		w := math.Exp(-float64(now.Sub(b.ewmaStamp)) / float64(peakEWMADecay))
+		b.PeakEWMA = time.Duration(float64(b.PeakEWMA)*w + float64(latency)*(1-w))
+	}
+	b.ewmaStamp = now
+}
+
+func (b *Backend) AddRetry() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Retries++
+}
+
+// AddBytes records the traffic of a closed layer-4 connection
+func (b *Backend) AddBytes(in, out int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.BytesIn += in
+	b.BytesOut += out
 }
 
 func (b *Backend) IncrementConnections() {
@@ -135,6 +288,19 @@ func (b *Backend) GetMetrics() BackendMetrics {
 		reqPerSec = float64(b.RequestCount) / uptime.Seconds()
 	}
 
+	var ejectedUntil *time.Time
+	ejected := time.Now().Before(b.EjectedUntil)
+	if ejected {
+		until := b.EjectedUntil
+		ejectedUntil = &until
+	}
+
+	var circuit *CircuitMetrics
+	if b.breaker != nil {
+		metrics := b.breaker.Metrics()
+		circuit = &metrics
+	}
+
 	return BackendMetrics{
 		URL:               b.URL.String(),
 		Alive:             b.Alive,
@@ -144,6 +310,16 @@ func (b *Backend) GetMetrics() BackendMetrics {
 		ActiveConnections: b.ActiveConnections,
 		RequestsPerSec:    reqPerSec,
 		TimeQuanta:        b.TimeQuanta,
+		Weight:            b.Weight,
+		PeakEWMA:          b.PeakEWMA,
+		Ejected:           ejected,
+		EjectedUntil:      ejectedUntil,
+		Ejections:         b.Ejections,
+		ConsecutiveErrors: b.consecutiveErrors,
+		Retries:           b.Retries,
+		BytesIn:           b.BytesIn,
+		BytesOut:          b.BytesOut,
+		Circuit:           circuit,
 	}
 
 }
@@ -154,8 +330,47 @@ func (b *Backend) GetTimeQuanta() time.Duration {
 	return b.TimeQuanta // Return 0 if no requests yet
 }
 
+func (b *Backend) GetAvgLatency() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.RequestCount == 0 {
+		return 0
+	}
+	return b.TotalLatency / time.Duration(b.RequestCount)
+}
+
+// GetLoad returns the peak-EWMA latency, in-flight requests and weight
+// in a single lock acquisition for the P2C scheduler
+func (b *Backend) GetLoad() (time.Duration, int64, int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.PeakEWMA, b.ActiveConnections, b.Weight
+}
+
 func (b *Backend) GetActiveConnections() int64 {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	return b.ActiveConnections
 }
+
+// HealthCheck returns the backend's active health check definition
+func (b *Backend) HealthCheck() *HealthCheck {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.healthCheck
+}
+
+// SetHealthCheck replaces the active health check definition
+func (b *Backend) SetHealthCheck(check *HealthCheck) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.healthCheck = check
+	b.healthSuccesses = 0
+	b.healthFailures = 0
+}
+
+func (b *Backend) GetWeight() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Weight
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCertReloadInterval = 30 * time.Second
+
+/*
+ * @ CertStore serves TLS certificates chosen by SNI. Certificates come
+ * from explicit cert/key pairs and from directories, and are reloaded
+ * when their files change or on demand without restarting listeners
+ */
+type CertStore struct {
+	pairs    []CertificateConfig
+	dirs     []string
+	interval time.Duration
+	// ACME fills its directory after startup, so it may start out empty
+	allowEmpty bool
+
+	index   atomic.Pointer[certIndex]
+	mu      sync.Mutex // serializes reloads
+	modTime map[string]time.Time
+}
+
+// certIndex is an immutable snapshot of the loaded certificates
+type certIndex struct {
+	byName   map[string][]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// NewCertStore loads the configured certificates. The legacy
+// cert_file/key_file pair comes first and is the default certificate.
+func NewCertStore(config *Config) (*CertStore, error) {
+	var pairs []CertificateConfig
+	if config.CertFile != "" || config.KeyFile != "" {
+		pairs = append(pairs, CertificateConfig{CertFile: config.CertFile, KeyFile: config.KeyFile})
+	}
+	pairs = append(pairs, config.Certificates...)
+
+	interval := time.Duration(config.CertReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultCertReloadInterval
+	}
+
+	store := &CertStore{
+		pairs:    pairs,
+		interval: interval,
+	}
+	if config.CertificatesDir != "" {
+		store.dirs = append(store.dirs, config.CertificatesDir)
+	}
+	if config.ACME.Enabled {
+		store.dirs = append(store.dirs, acmeStorageDir(config.ACME))
+		store.allowEmpty = true
+	}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads all certificates from disk and swaps them in. On error
+// the previously loaded certificates stay in use.
+func (s *CertStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pairs, err := s.allPairs()
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 && !s.allowEmpty {
+		return fmt.Errorf("no certificates configured")
+	}
+
+	index := &certIndex{byName: make(map[string][]*tls.Certificate)}
+	modTime := make(map[string]time.Time)
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", pair.CertFile, err)
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("parsing %s: %w", pair.CertFile, err)
+			}
+			cert.Leaf = leaf
+		}
+
+		names := certificateNames(leaf)
+		for _, name := range names {
+			index.byName[name] = append(index.byName[name], &cert)
+		}
+		if index.fallback == nil {
+			index.fallback = &cert
+		}
+		log.Printf("Loaded certificate %s for %s (expires %s)", pair.CertFile, strings.Join(names, ", "), leaf.NotAfter.Format(time.DateOnly))
+
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if info, err := os.Stat(file); err == nil {
+				modTime[file] = info.ModTime()
+			}
+		}
+	}
+
+	s.index.Store(index)
+	s.modTime = modTime
+	return nil
+}
+
+// allPairs returns the configured pairs plus those found in the directories.
+// A directory entry is a "name.crt" or "name.pem" file with a "name.key" next to it.
+func (s *CertStore) allPairs() ([]CertificateConfig, error) {
+	pairs := slices.Clone(s.pairs)
+	for _, dir := range s.dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) && s.allowEmpty {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+				continue
+			}
+			key := filepath.Join(dir, strings.TrimSuffix(entry.Name(), ext)+".key")
+			if _, err := os.Stat(key); err != nil {
+				continue
+			}
+			pairs = append(pairs, CertificateConfig{CertFile: filepath.Join(dir, entry.Name()), KeyFile: key})
+		}
+	}
+	return pairs, nil
+}
+
+// changed reports whether any certificate file, or the directory
+// contents, differ from what was last loaded
+func (s *CertStore) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pairs, err := s.allPairs()
+	if err != nil {
+		return false
+	}
+	// A combined PEM may serve as both cert and key, or appear in
+	// several pairs, so distinct paths are compared
+	files := make(map[string]bool)
+	for _, pair := range pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if files[file] {
+				continue
+			}
+			files[file] = true
+			info, err := os.Stat(file)
+			if err != nil {
+				return true
+			}
+			if loaded, ok := s.modTime[file]; !ok || !info.ModTime().Equal(loaded) {
+				return true
+			}
+		}
+	}
+	return len(files) != len(s.modTime)
+}
+
+// Watch polls the certificate files and reloads them when they change
+func (s *CertStore) Watch(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.changed() {
+				if err := s.Reload(); err != nil {
+					log.Printf("Certificate reload failed, keeping previous certificates: %v", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// GetCertificate picks a certificate for the ClientHello: an exact name
+// match, then a wildcard, then the default certificate. When several
+// certificates cover a name (e.g. ECDSA and RSA) the first the client
+// supports is used.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	index := s.index.Load()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	candidates := index.byName[name]
+	if len(candidates) == 0 {
+		if _, rest, ok := strings.Cut(name, "."); ok {
+			candidates = index.byName["*."+rest]
+		}
+	}
+	for _, cert := range candidates {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0], nil
+	}
+	return index.fallback, nil
+}
+
+// certificateNames returns the lower-cased DNS names a certificate covers
+func certificateNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	lower := make([]string, len(names))
+	for i, name := range names {
+		lower[i] = strings.ToLower(name)
+	}
+	return lower
+}
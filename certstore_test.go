@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertStoreChanged(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certsDir := filepath.Join(dir, "certs")
+	if err := os.Mkdir(certsDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	_, certPEM, keyPEM := ca.issue(t, "a.example.com", "a.example.com")
+	combined := writeTestFile(t, dir, "combined.pem", append(certPEM, keyPEM...))
+	_, certPEM, keyPEM = ca.issue(t, "b.example.com", "b.example.com")
+	writeTestFile(t, certsDir, "b.crt", certPEM)
+	writeTestFile(t, certsDir, "b.key", keyPEM)
+
+	store, err := NewCertStore(&Config{
+		CertFile:        combined,
+		KeyFile:         combined,
+		Certificates:    []CertificateConfig{{CertFile: combined, KeyFile: combined}},
+		CertificatesDir: certsDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.changed() {
+		t.Fatal("unchanged files reported as changed")
+	}
+
+	// Touching a file is noticed
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(combined, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !store.changed() {
+		t.Fatal("modified combined PEM not noticed")
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if store.changed() {
+		t.Fatal("reported as changed right after a reload")
+	}
+
+	// So is a new pair in the directory
+	_, certPEM, keyPEM = ca.issue(t, "c.example.com", "c.example.com")
+	writeTestFile(t, certsDir, "c.crt", certPEM)
+	writeTestFile(t, certsDir, "c.key", keyPEM)
+	if !store.changed() {
+		t.Fatal("new certificate in the directory not noticed")
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// And a removed one
+	os.Remove(filepath.Join(certsDir, "b.key"))
+	if !store.changed() {
+		t.Fatal("removed certificate not noticed")
+	}
+}
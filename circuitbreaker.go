@@ -0,0 +1,240 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Circuit breaker defaults
+const (
+	defaultErrorRateThreshold = 0.5
+	defaultMinRequests        = 20
+	defaultBreakerWindow      = 10 * time.Second
+	defaultOpenTime           = 30 * time.Second
+	defaultHalfOpenRequests   = 3
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitMetrics represents the state of a circuit breaker for monitoring
+type CircuitMetrics struct {
+	State       string  `json:"state"`
+	ErrorRate   float64 `json:"error_rate"`
+	Opened      int64   `json:"opened"`
+	HalfOpened  int64   `json:"half_opened"`
+	Closed      int64   `json:"closed"`
+	LastChanged string  `json:"last_changed,omitempty"`
+}
+
+/*
+ * @ CircuitBreaker guards a single backend
+ * closed: requests flow, failures are counted per window and the
+ *         breaker opens once the error rate crosses the threshold
+ * open: the backend is skipped until the open period elapses
+ * half-open: a limited number of trial requests are let through,
+ *            all must succeed to close, any failure reopens
+ */
+type CircuitBreaker struct {
+	name               string
+	errorRateThreshold float64
+	latencyThreshold   time.Duration
+	minRequests        int
+	window             time.Duration
+	openTime           time.Duration
+	halfOpenRequests   int
+
+	mu          sync.Mutex
+	state       CircuitState
+	generation  uint64
+	changedAt   time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	admitted    int
+	successes   int
+
+	opened     int64
+	halfOpened int64
+	closed     int64
+}
+
+// NewCircuitBreaker creates a named circuit breaker, applying defaults for unset fields
+func NewCircuitBreaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		name:               name,
+		errorRateThreshold: config.ErrorRateThreshold,
+		latencyThreshold:   time.Duration(config.LatencyThreshold) * time.Millisecond,
+		minRequests:        config.MinRequests,
+		window:             time.Duration(config.Window) * time.Second,
+		openTime:           time.Duration(config.OpenTime) * time.Second,
+		halfOpenRequests:   config.HalfOpenRequests,
+		windowStart:        time.Now(),
+	}
+	if cb.errorRateThreshold <= 0 || cb.errorRateThreshold > 1 {
+		cb.errorRateThreshold = defaultErrorRateThreshold
+	}
+	if cb.minRequests <= 0 {
+		cb.minRequests = defaultMinRequests
+	}
+	if cb.window <= 0 {
+		cb.window = defaultBreakerWindow
+	}
+	if cb.openTime <= 0 {
+		cb.openTime = defaultOpenTime
+	}
+	if cb.halfOpenRequests <= 0 {
+		cb.halfOpenRequests = defaultHalfOpenRequests
+	}
+	return cb
+}
+
+// Ready reports whether the breaker would let a request through.
+// An open breaker whose open period has elapsed moves to half-open.
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.changedAt) < cb.openTime {
+			return false
+		}
+		cb.transition(CircuitHalfOpen)
+		return true
+	case CircuitHalfOpen:
+		return cb.admitted < cb.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// Acquire admits a request that was scheduled to the backend.
+// In half-open state only the configured number of trials are admitted.
+// The returned generation identifies the state the request was admitted
+// in and must be passed back to Record.
+func (cb *CircuitBreaker) Acquire() (uint64, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		return cb.generation, false
+	case CircuitHalfOpen:
+		if cb.admitted >= cb.halfOpenRequests {
+			return cb.generation, false
+		}
+		cb.admitted++
+		return cb.generation, true
+	default:
+		return cb.generation, true
+	}
+}
+
+// Record reports the outcome of a request admitted in the given generation.
+// Requests slower than the latency threshold count as failures. Outcomes
+// of requests admitted before the last state change are ignored, so a slow
+// request sent while closed cannot decide a half-open trial.
+func (cb *CircuitBreaker) Record(generation uint64, failed bool, latency time.Duration) {
+	if cb.latencyThreshold > 0 && latency > cb.latencyThreshold {
+		failed = true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation != cb.generation {
+		return
+	}
+
+	switch cb.state {
+	case CircuitClosed:
+		now := time.Now()
+		if now.Sub(cb.windowStart) >= cb.window {
+			cb.windowStart = now
+			cb.requests = 0
+			cb.failures = 0
+		}
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if cb.requests >= cb.minRequests && cb.errorRate() >= cb.errorRateThreshold {
+			cb.transition(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		if failed {
+			cb.transition(CircuitOpen)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.halfOpenRequests {
+			cb.transition(CircuitClosed)
+		}
+	}
+}
+
+// Metrics returns a snapshot of the breaker state and transition counts
+func (cb *CircuitBreaker) Metrics() CircuitMetrics {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	metrics := CircuitMetrics{
+		State:      cb.state.String(),
+		ErrorRate:  cb.errorRate(),
+		Opened:     cb.opened,
+		HalfOpened: cb.halfOpened,
+		Closed:     cb.closed,
+	}
+	if !cb.changedAt.IsZero() {
+		metrics.LastChanged = cb.changedAt.Format(time.RFC3339)
+	}
+	return metrics
+}
+
+func (cb *CircuitBreaker) errorRate() float64 {
+	if cb.requests == 0 {
+		return 0
+	}
+	return float64(cb.failures) / float64(cb.requests)
+}
+
+// transition moves the breaker to a new state and resets the counters of the old one
+func (cb *CircuitBreaker) transition(state CircuitState) {
+	cb.state = state
+	cb.generation++
+	cb.changedAt = time.Now()
+	cb.admitted = 0
+	cb.successes = 0
+	cb.requests = 0
+	cb.failures = 0
+	cb.windowStart = cb.changedAt
+
+	switch state {
+	case CircuitOpen:
+		cb.opened++
+	case CircuitHalfOpen:
+		cb.halfOpened++
+	case CircuitClosed:
+		cb.closed++
+	}
+	log.Printf("Circuit breaker for %s is now %s", cb.name, state)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// openBreaker returns a breaker that opened on failures and whose open
+// period has already elapsed
+func openBreaker(t *testing.T, halfOpenRequests int) *CircuitBreaker {
+	t.Helper()
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{MinRequests: 2, HalfOpenRequests: halfOpenRequests})
+	for range 2 {
+		generation, ok := cb.Acquire()
+		if !ok {
+			t.Fatal("closed breaker refused a request")
+		}
+		cb.Record(generation, true, 0)
+	}
+	if cb.state != CircuitOpen {
+		t.Fatalf("state = %s, want open", cb.state)
+	}
+	cb.openTime = 0
+	return cb
+}
+
+func TestCircuitBreakerHalfOpenTrials(t *testing.T) {
+	cb := openBreaker(t, 2)
+	if !cb.Ready() || cb.state != CircuitHalfOpen {
+		t.Fatalf("state = %s, want half-open", cb.state)
+	}
+
+	first, ok1 := cb.Acquire()
+	second, ok2 := cb.Acquire()
+	if !ok1 || !ok2 {
+		t.Fatal("half-open breaker refused a trial")
+	}
+	if _, ok := cb.Acquire(); ok {
+		t.Fatal("half-open breaker admitted more trials than configured")
+	}
+
+	cb.Record(first, false, 0)
+	if cb.state != CircuitHalfOpen {
+		t.Fatalf("state = %s after one success, want half-open", cb.state)
+	}
+	cb.Record(second, false, 0)
+	if cb.state != CircuitClosed {
+		t.Fatalf("state = %s after all trials succeeded, want closed", cb.state)
+	}
+
+	cb = openBreaker(t, 2)
+	cb.Ready()
+	generation, _ := cb.Acquire()
+	cb.Record(generation, true, 0)
+	if cb.state != CircuitOpen {
+		t.Fatalf("state = %s after a failed trial, want open", cb.state)
+	}
+}
+
+func TestCircuitBreakerIgnoresStaleOutcomes(t *testing.T) {
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{MinRequests: 2, HalfOpenRequests: 1})
+	// A slow request admitted while closed
+	slow, _ := cb.Acquire()
+	for range 2 {
+		generation, _ := cb.Acquire()
+		cb.Record(generation, true, 0)
+	}
+	cb.openTime = 0
+	cb.Ready()
+
+	cb.Record(slow, false, 0)
+	if cb.state != CircuitHalfOpen {
+		t.Fatalf("a request admitted while closed decided the trial: state = %s", cb.state)
+	}
+
+	trial, ok := cb.Acquire()
+	if !ok {
+		t.Fatal("half-open breaker refused its trial")
+	}
+	cb.Record(trial, false, 0)
+	if cb.state != CircuitClosed {
+		t.Fatalf("state = %s, want closed", cb.state)
+	}
+}
+
+func TestCircuitBreakerLatencyThreshold(t *testing.T) {
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{MinRequests: 1, LatencyThreshold: 100})
+	generation, _ := cb.Acquire()
+	cb.Record(generation, false, time.Second)
+	if cb.state != CircuitOpen {
+		t.Fatalf("state = %s after a slow request, want open", cb.state)
+	}
+}
+
+// An aborted response body must still end the half-open trial
+func TestPoolRecordsAbortedResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		// Promise more body than is sent, then drop the connection
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+		buf.Flush()
+	}))
+	defer backend.Close()
+
+	pool, err := NewPool("default", PoolConfig{
+		CircuitBreaker: CircuitBreakerConfig{Enabled: true, HalfOpenRequests: 1},
+		Backends:       []BackendConfig{{URL: backend.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker := pool.GetBackends()[0].breaker
+	breaker.transition(CircuitHalfOpen)
+
+	frontend := httptest.NewServer(pool)
+	defer frontend.Close()
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == nil {
+		var buf [128]byte
+		for err == nil {
+			_, err = res.Body.Read(buf[:])
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for breaker.Metrics().State != CircuitOpen.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %s, want the failed trial to reopen the breaker", breaker.Metrics().State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -6,17 +6,191 @@ import (
 	"time"
 )
 
-// Config represents the load balancer configuration
+// Config represents the load balancer configuration.
+// The embedded PoolConfig describes the default pool, so configs
+// written before named pools existed keep working unchanged.
 type Config struct {
-	Port                int             `json:"port"`
-	HTTPSPort           int             `json:"https_port"`
-	EnableHTTPS         bool            `json:"enable_https"`
-	CertFile            string          `json:"cert_file"`
-	KeyFile             string          `json:"key_file"`
-	HealthCheckPath     string          `json:"health_check_path"`
-	HealthCheckInterval time.Duration   `json:"health_check_interval_seconds"`
-	Auth                AuthConfig      `json:"auth"`
-	Backends            []BackendConfig `json:"backends"`
+	Port        int    `json:"port"`
+	HTTPSPort   int    `json:"https_port"`
+	EnableHTTPS bool   `json:"enable_https"`
+	CertFile    string `json:"cert_file"`
+	KeyFile     string `json:"key_file"`
+
+	Certificates       []CertificateConfig `json:"certificates"`
+	CertificatesDir    string              `json:"certificates_dir"`
+	CertReloadInterval int                 `json:"cert_reload_interval_seconds"`
+	ClientAuth         ClientAuthConfig    `json:"client_auth"`
+	ACME               ACMEConfig          `json:"acme"`
+	ListenerTLS        ListenerTLSConfig   `json:"listener_tls"`
+
+	TrustedProxies  []string            `json:"trusted_proxies"`
+	ForwardedHeader bool                `json:"forwarded_header"`
+	ProxyProtocol   ProxyProtocolConfig `json:"proxy_protocol"`
+
+	HTTPSPolicyConfig
+
+	PoolConfig
+	Pools        map[string]PoolConfig `json:"pools"`
+	Frontends    []FrontendConfig      `json:"frontends"`
+	Routes       []RouteConfig         `json:"routes"`
+	TCPListeners []TCPListenerConfig   `json:"tcp_listeners"`
+	UDPListeners []UDPListenerConfig   `json:"udp_listeners"`
+	Auth         AuthConfig            `json:"auth"`
+	StateFile    string                `json:"state_file"`
+}
+
+// PoolConfig represents a named group of backends with its own
+// scheduler, health checks and traffic policies
+type PoolConfig struct {
+	HealthCheckPath     string               `json:"health_check_path"`
+	HealthCheckInterval time.Duration        `json:"health_check_interval_seconds"`
+	HealthCheck         HealthCheckConfig    `json:"health_check"`
+	Algorithm           string               `json:"algorithm"`
+	Hash                HashConfig           `json:"hash"`
+	Sticky              StickyConfig         `json:"sticky"`
+	OutlierDetection    OutlierConfig        `json:"outlier_detection"`
+	CircuitBreaker      CircuitBreakerConfig `json:"circuit_breaker"`
+	Retry               RetryConfig          `json:"retry"`
+	HeaderRules         HeaderRulesConfig    `json:"header_rules"`
+	SendProxyProtocol   string               `json:"send_proxy_protocol"`
+	TLS                 UpstreamTLSConfig    `json:"tls"`
+	Backends            []BackendConfig      `json:"backends"`
+}
+
+// FrontendConfig maps requests for a set of host names to a pool.
+// Hosts may be exact names or wildcards like "*.example.com".
+type FrontendConfig struct {
+	Hosts []string `json:"hosts"`
+	Pool  string   `json:"pool"`
+
+	HTTPSPolicyConfig
+	// PlainHTTP opts the hosts out of the top-level HTTPS policy
+	PlainHTTP bool `json:"plain_http"`
+}
+
+// HTTPSPolicyConfig represents the HTTP to HTTPS redirect and HSTS
+// settings of a frontend, or of all other hosts at the top level
+type HTTPSPolicyConfig struct {
+	RedirectHTTPS  bool       `json:"redirect_https"`
+	RedirectPort   int        `json:"redirect_port"`
+	RedirectExempt []string   `json:"redirect_exempt_paths"`
+	HSTS           HSTSConfig `json:"hsts"`
+}
+
+// HSTSConfig represents the Strict-Transport-Security header
+type HSTSConfig struct {
+	MaxAge            int  `json:"max_age_seconds"`
+	IncludeSubdomains bool `json:"include_subdomains"`
+	Preload           bool `json:"preload"`
+}
+
+// TCPListenerConfig represents a layer-4 listener that splices
+// connections to a pool of TCP backends. With SNI routes the pool is
+// chosen by TLS server name and pool is the fallback.
+type TCPListenerConfig struct {
+	Name           string           `json:"name"`
+	Listen         string           `json:"listen"`
+	Pool           string           `json:"pool"`
+	SNI            []FrontendConfig `json:"sni"`
+	ConnectTimeout int              `json:"connect_timeout_seconds"`
+	IdleTimeout    int              `json:"idle_timeout_seconds"`
+}
+
+// UDPListenerConfig represents a listener that forwards datagrams
+// to a pool of UDP backends
+type UDPListenerConfig struct {
+	Name           string `json:"name"`
+	Listen         string `json:"listen"`
+	Pool           string `json:"pool"`
+	SessionTimeout int    `json:"session_timeout_seconds"`
+}
+
+// RouteConfig represents an ordered routing rule. Every predicate that
+// is set must match; the first matching route selects the pool.
+type RouteConfig struct {
+	Name        string            `json:"name"`
+	Hosts       []string          `json:"hosts"`
+	PathPrefix  string            `json:"path_prefix"`
+	Path        string            `json:"path"`
+	PathRegex   string            `json:"path_regex"`
+	Methods     []string          `json:"methods"`
+	Headers     map[string]string `json:"headers"`
+	Query       map[string]string `json:"query"`
+	Pool        string            `json:"pool"`
+	StripPrefix bool              `json:"strip_prefix"`
+	HeaderRules HeaderRulesConfig `json:"header_rules"`
+
+	ClientIdentities []string `json:"client_identities"`
+}
+
+// HeaderRulesConfig represents header manipulation for proxied
+// requests and the responses returned to clients
+type HeaderRulesConfig struct {
+	Request  HeaderOpsConfig `json:"request"`
+	Response HeaderOpsConfig `json:"response"`
+}
+
+// HeaderOpsConfig lists headers to set, append and remove. Values may
+// contain placeholders such as {client_ip} or {request_id}.
+type HeaderOpsConfig struct {
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+	Remove []string          `json:"remove"`
+}
+
+// CertificateConfig represents a TLS certificate and its private key
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// ListenerTLSConfig represents the protocol settings of the HTTPS listener
+type ListenerTLSConfig struct {
+	MinVersion             string   `json:"min_version"`
+	MaxVersion             string   `json:"max_version"`
+	CipherSuites           []string `json:"cipher_suites"`
+	Curves                 []string `json:"curves"`
+	ALPN                   []string `json:"alpn"`
+	SessionTicketsDisabled bool     `json:"session_tickets_disabled"`
+	SessionTicketRotation  int      `json:"session_ticket_rotation_seconds"`
+	LogClientHello         bool     `json:"log_client_hello"`
+}
+
+// ACMEConfig represents automatic certificate issuance from an ACME CA
+type ACMEConfig struct {
+	Enabled      bool     `json:"enabled"`
+	DirectoryURL string   `json:"directory_url"`
+	Email        string   `json:"email"`
+	Domains      []string `json:"domains"`
+	Challenge    string   `json:"challenge"`
+	StorageDir   string   `json:"storage_dir"`
+	CAFile       string   `json:"ca_file"`
+	RenewBefore  int      `json:"renew_before_days"`
+}
+
+// ClientAuthConfig represents client certificate verification on the
+// HTTPS listener
+type ClientAuthConfig struct {
+	CAFile         string `json:"ca_file"`
+	Mode           string `json:"mode"`
+	IdentityHeader string `json:"identity_header"`
+}
+
+// UpstreamTLSConfig represents the TLS settings used to connect to a
+// pool's https backends
+type UpstreamTLSConfig struct {
+	CAFile     string `json:"ca_file"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	ServerName string `json:"server_name"`
+	SkipVerify bool   `json:"skip_verify"`
+}
+
+// ProxyProtocolConfig represents PROXY protocol support on the listeners
+type ProxyProtocolConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Sources       []string `json:"sources"`
+	HeaderTimeout int      `json:"header_timeout_seconds"`
 }
 
 // AuthConfig represents authentication configuration
@@ -26,9 +200,76 @@ type AuthConfig struct {
 	Password string `json:"password"`
 }
 
+// HashConfig represents the consistent-hash strategy configuration
+type HashConfig struct {
+	Key          string `json:"key"`
+	Name         string `json:"name"`
+	Segment      int    `json:"segment"`
+	VirtualNodes int    `json:"virtual_nodes"`
+}
+
+// StickyConfig represents cookie-based session affinity configuration
+type StickyConfig struct {
+	Enabled    bool   `json:"enabled"`
+	CookieName string `json:"cookie_name"`
+	Secret     string `json:"secret"`
+	MaxAge     int    `json:"max_age_seconds"`
+}
+
+// OutlierConfig represents passive health checking configuration
+type OutlierConfig struct {
+	Enabled            bool `json:"enabled"`
+	ConsecutiveErrors  int  `json:"consecutive_errors"`
+	BaseEjectionTime   int  `json:"base_ejection_seconds"`
+	MaxEjectionTime    int  `json:"max_ejection_seconds"`
+	MaxEjectionPercent int  `json:"max_ejection_percent"`
+}
+
+// CircuitBreakerConfig represents per-backend circuit breaker configuration
+type CircuitBreakerConfig struct {
+	Enabled            bool    `json:"enabled"`
+	ErrorRateThreshold float64 `json:"error_rate_threshold"`
+	LatencyThreshold   int     `json:"latency_threshold_ms"`
+	MinRequests        int     `json:"min_requests"`
+	Window             int     `json:"window_seconds"`
+	OpenTime           int     `json:"open_seconds"`
+	HalfOpenRequests   int     `json:"half_open_requests"`
+}
+
+// RetryConfig represents the retry policy for failed requests
+type RetryConfig struct {
+	MaxAttempts        int      `json:"max_attempts"`
+	RetryOn            []string `json:"retry_on"`
+	RetryNonIdempotent bool     `json:"retry_non_idempotent"`
+	MaxBodyBytes       int64    `json:"max_body_bytes"`
+}
+
 // BackendConfig represents a backend server configuration
 type BackendConfig struct {
-	URL string `json:"url"`
+	URL         string             `json:"url"`
+	Weight      int                `json:"weight"`
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+}
+
+// HealthCheckConfig represents active health check settings, used for the
+// whole pool and as per-backend overrides
+type HealthCheckConfig struct {
+	Type              string            `json:"type,omitempty"`
+	Path              string            `json:"path,omitempty"`
+	Port              int               `json:"port,omitempty"`
+	Timeout           int               `json:"timeout_seconds,omitempty"`
+	ExpectedStatuses  []string          `json:"expected_statuses,omitempty"`
+	ExpectedBody      string            `json:"expected_body,omitempty"`
+	ExpectedBodyRegex string            `json:"expected_body_regex,omitempty"`
+	Host              string            `json:"host,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	Rise              int               `json:"rise,omitempty"`
+	Fall              int               `json:"fall,omitempty"`
+	ServerName        string            `json:"server_name,omitempty"`
+	SkipVerify        bool              `json:"tls_skip_verify,omitempty"`
+	GRPCService       string            `json:"grpc_service,omitempty"`
+	Send              string            `json:"send,omitempty"`
+	SendHex           string            `json:"send_hex,omitempty"`
 }
 
 // LoadConfig loads configuration from a JSON file
@@ -45,8 +286,22 @@ func LoadConfig(filepath string) (*Config, error) {
 		return nil, err
 	}
 
-	// Convert seconds to duration
-	config.HealthCheckInterval = config.HealthCheckInterval * time.Second
+	normalizePool(&config.PoolConfig)
+	for name, pool := range config.Pools {
+		normalizePool(&pool)
+		config.Pools[name] = pool
+	}
 
 	return &config, nil
 }
+
+// normalizePool converts units and resolves legacy pool fields
+func normalizePool(pool *PoolConfig) {
+	// Convert seconds to duration
+	pool.HealthCheckInterval = pool.HealthCheckInterval * time.Second
+
+	// health_check_path is kept for older configs
+	if pool.HealthCheck.Path == "" {
+		pool.HealthCheck.Path = pool.HealthCheckPath
+	}
+}
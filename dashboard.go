@@ -215,6 +215,10 @@ const dashboardHTML = `
             background: #ef4444;
             color: white;
         }
+        .status-ejected {
+            background: #f59e0b;
+            color: white;
+        }
         .metric {
             display: flex;
             justify-content: space-between;
@@ -268,16 +272,26 @@ const dashboardHTML = `
             <div class="backend-card">
                 <div class="backend-header">
                     <div class="backend-url">{{.URL}}</div>
-                    {{if .Alive}}
+                    {{if .Ejected}}
+                    <span class="status status-ejected">EJECTED</span>
+                    {{else if .Alive}}
                     <span class="status status-up">UP</span>
                     {{else}}
                     <span class="status status-down">DOWN</span>
                     {{end}}
                 </div>
+                <div class="metric">
+                    <span class="metric-label">Pool</span>
+                    <span class="metric-value">{{.Pool}}</span>
+                </div>
                 <div class="metric">
                     <span class="metric-label">Requests</span>
                     <span class="metric-value">{{.RequestCount}}</span>
                 </div>
+                <div class="metric">
+                    <span class="metric-label">Weight</span>
+                    <span class="metric-value">{{.Weight}}</span>
+                </div>
                 <div class="metric">
                     <span class="metric-label">Avg Latency</span>
                     <span class="metric-value">{{.AvgLatencyMs}}</span>
@@ -286,6 +300,10 @@ const dashboardHTML = `
                     <span class="metric-label">Uptime</span>
                     <span class="metric-value">{{.UptimeStr}}</span>
                 </div>
+                <div class="metric">
+                    <span class="metric-label">Ejections</span>
+                    <span class="metric-value">{{.Ejections}}</span>
+                </div>
             </div>
             {{end}}
         </div>
@@ -326,8 +344,12 @@ func NewDashboard(lb *LoadBalancer) (*Dashboard, error) {
 // MetricsView represents the metrics in a view-friendly format
 type MetricsView struct {
 	URL          string
+	Pool         string
 	Alive        bool
+	Ejected      bool
+	Ejections    int64
 	RequestCount int64
+	Weight       int
 	AvgLatencyMs string
 	UptimeStr    string
 }
@@ -340,8 +362,12 @@ func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, m := range metrics {
 		view := MetricsView{
 			URL:          m.URL,
+			Pool:         m.Pool,
 			Alive:        m.Alive,
+			Ejected:      m.Ejected,
+			Ejections:    m.Ejections,
 			RequestCount: m.RequestCount,
+			Weight:       m.Weight,
 			AvgLatencyMs: fmt.Sprintf("%.2f ms", float64(m.AvgLatency.Microseconds())/1000.0),
 			UptimeStr:    formatDuration(m.Uptime),
 		}
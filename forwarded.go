@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * @ TrustedProxies is the set of networks whose X-Forwarded-* and
+ * Forwarded headers are believed. Headers from any other peer are
+ * discarded and replaced with what FluxLB observed itself
+ */
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies parses a list of IP addresses and CIDR ranges
+func NewTrustedProxies(entries []string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			tp.prefixes = append(tp.prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		tp.prefixes = append(tp.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return tp, nil
+}
+
+// Trusts reports whether the address belongs to a trusted proxy
+func (tp *TrustedProxies) Trusts(ip string) bool {
+	if tp == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range tp.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedInfo describes the original client request as seen
+// through any trusted proxies in front of FluxLB
+type forwardedInfo struct {
+	clientIP   string
+	clientPort uint16 // known only when the client is the direct peer
+	proto      string
+	host       string
+	port       string
+	chain      []string // X-Forwarded-For entries to send upstream
+	prior      []string // Forwarded elements received from trusted proxies
+	emit       bool     // send an RFC 7239 Forwarded header upstream
+	hop        string   // Forwarded element describing the request FluxLB received
+}
+
+// newForwardedInfo resolves the client address, scheme and host of a request
+func newForwardedInfo(r *http.Request, trusted *TrustedProxies, emit bool) *forwardedInfo {
+	peer, peerPort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	info := &forwardedInfo{
+		clientIP: peer,
+		proto:    scheme,
+		host:     r.Host,
+		emit:     emit,
+		hop:      "for=" + forwardedNode(peer) + ";host=" + forwardedValue(r.Host) + ";proto=" + scheme,
+	}
+
+	if trusted.Trusts(peer) {
+		// The Forwarded header wins over the X-Forwarded-* family when both are sent
+		if values := r.Header.Values("Forwarded"); len(values) > 0 {
+			info.prior = values
+			var elements []map[string]string
+			for _, element := range parseForwarded(values) {
+				if element["for"] != "" {
+					elements = append(elements, element)
+					info.chain = append(info.chain, hopAddress(element["for"]))
+				}
+			}
+
+			// proto and host describe the request as received by the proxy
+			// that recorded the client, so take them from the same element
+			if i := clientHop(info.chain, trusted); i >= 0 {
+				info.clientIP = info.chain[i]
+				if proto := elements[i]["proto"]; proto != "" {
+					info.proto = strings.ToLower(proto)
+				}
+				if host := elements[i]["host"]; host != "" {
+					info.host = host
+				}
+			}
+		} else {
+			for _, hop := range splitHeaderList(r.Header.Values("X-Forwarded-For")) {
+				info.chain = append(info.chain, hopAddress(hop))
+			}
+			if i := clientHop(info.chain, trusted); i >= 0 {
+				info.clientIP = info.chain[i]
+			}
+			if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto != "" {
+				info.proto = strings.ToLower(proto)
+			}
+			if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+				info.host = host
+			}
+			if port := firstHeaderValue(r, "X-Forwarded-Port"); port != "" {
+				info.port = port
+			}
+		}
+	}
+	relayed := len(info.chain) > 0
+	if info.clientIP == peer {
+		if port, err := strconv.ParseUint(peerPort, 10, 16); err == nil {
+			info.clientPort = uint16(port)
+		}
+	}
+	info.chain = append(info.chain, peer)
+
+	// Without a forwarded port, use the port of the original Host, then
+	// the listener port for direct clients, then the scheme default
+	if info.port == "" {
+		if _, port, err := net.SplitHostPort(info.host); err == nil {
+			info.port = port
+		} else if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && !relayed {
+			_, info.port, _ = net.SplitHostPort(addr.String())
+		}
+	}
+	if info.port == "" {
+		if info.proto == "https" {
+			info.port = "443"
+		} else {
+			info.port = "80"
+		}
+	}
+	return info
+}
+
+// clientHop walks the hops right to left and returns the index of the
+// first untrusted address, or of the leftmost hop if all are trusted
+func clientHop(hops []string, trusted *TrustedProxies) int {
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !trusted.Trusts(hops[i]) {
+			return i
+		}
+	}
+	if len(hops) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// setHeaders writes the forwarding headers onto the outbound request
+func (f *forwardedInfo) setHeaders(out *http.Request) {
+	out.Header.Set("X-Forwarded-For", strings.Join(f.chain, ", "))
+	out.Header.Set("X-Forwarded-Proto", f.proto)
+	out.Header.Set("X-Forwarded-Host", f.host)
+	out.Header.Set("X-Forwarded-Port", f.port)
+
+	if f.emit {
+		out.Header.Set("Forwarded", strings.Join(append(slices.Clone(f.prior), f.hop), ", "))
+	} else {
+		out.Header.Del("Forwarded")
+	}
+}
+
+// rewriteForwarded sets the forwarding headers of a proxied request
+func rewriteForwarded(pr *httputil.ProxyRequest) {
+	info := requestInfoFrom(pr.In.Context())
+	if info == nil || info.forwarded == nil {
+		pr.SetXForwarded()
+		return
+	}
+	info.forwarded.setHeaders(pr.Out)
+}
+
+// clientIP returns the IP address of the original client, honouring
+// forwarding headers from trusted proxies
+func clientIP(r *http.Request) string {
+	if info := requestInfoFrom(r.Context()); info != nil && info.forwarded != nil {
+		return info.forwarded.clientIP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseForwarded parses RFC 7239 Forwarded header values into elements
+func parseForwarded(values []string) []map[string]string {
+	var elements []map[string]string
+	for _, value := range values {
+		for _, raw := range splitQuoted(value, ',') {
+			element := make(map[string]string)
+			for _, pair := range splitQuoted(raw, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.TrimSpace(val)
+				if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+					val = strings.ReplaceAll(val[1:len(val)-1], `\"`, `"`)
+				}
+				element[strings.ToLower(strings.TrimSpace(key))] = val
+			}
+			if len(element) > 0 {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
+
+// splitQuoted splits s on sep, ignoring separators inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitHeaderList splits comma-separated header values
+func splitHeaderList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func firstHeaderValue(r *http.Request, name string) string {
+	items := splitHeaderList(r.Header.Values(name))
+	if len(items) == 0 {
+		return ""
+	}
+	return items[0]
+}
+
+// hopAddress strips the port and brackets from a Forwarded node or
+// X-Forwarded-For entry, e.g. "[2001:db8::1]:4711" or "192.0.2.1:80"
+func hopAddress(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+// forwardedNode formats an address as a Forwarded node; IPv6 must be quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes a Forwarded parameter value unless it is a token
+func forwardedValue(s string) string {
+	for _, c := range s {
+		if !isTokenChar(c) {
+			return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+		}
+	}
+	return s
+}
+
+func isTokenChar(c rune) bool {
+	return c < 127 && c > 32 && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+}
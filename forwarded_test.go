@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNewForwardedInfo(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remote     string
+		headers    map[string][]string
+		clientIP   string
+		clientPort uint16
+		proto      string
+		host       string
+		port       string
+		chain      []string
+	}{
+		{
+			name:       "direct client",
+			remote:     "203.0.113.5:4000",
+			clientIP:   "203.0.113.5",
+			clientPort: 4000,
+			proto:      "http",
+			host:       "example.com",
+			port:       "80",
+			chain:      []string{"203.0.113.5"},
+		},
+		{
+			name:   "spoofed x-forwarded headers from untrusted peer",
+			remote: "203.0.113.5:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+				"X-Forwarded-Port":  {"8443"},
+			},
+			clientIP:   "203.0.113.5",
+			clientPort: 4000,
+			proto:      "http",
+			host:       "example.com",
+			port:       "80",
+			chain:      []string{"203.0.113.5"},
+		},
+		{
+			name:   "spoofed forwarded header from untrusted peer",
+			remote: "203.0.113.5:4000",
+			headers: map[string][]string{
+				"Forwarded": {"for=198.51.100.7;proto=https;host=evil.example"},
+			},
+			clientIP:   "203.0.113.5",
+			clientPort: 4000,
+			proto:      "http",
+			host:       "example.com",
+			port:       "80",
+			chain:      []string{"203.0.113.5"},
+		},
+		{
+			name:   "one trusted proxy",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"HTTPS"},
+				"X-Forwarded-Host":  {"shop.example.com"},
+			},
+			clientIP: "198.51.100.7",
+			proto:    "https",
+			host:     "shop.example.com",
+			port:     "443",
+			chain:    []string{"198.51.100.7", "10.0.0.1"},
+		},
+		{
+			name:   "multi-hop trusted chain ignores client-supplied entries",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"1.2.3.4, 198.51.100.7", "10.0.0.2"},
+			},
+			clientIP: "198.51.100.7",
+			proto:    "http",
+			host:     "example.com",
+			port:     "80",
+			chain:    []string{"1.2.3.4", "198.51.100.7", "10.0.0.2", "10.0.0.1"},
+		},
+		{
+			name:   "all hops trusted",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"},
+			},
+			clientIP: "10.0.0.3",
+			proto:    "http",
+			host:     "example.com",
+			port:     "80",
+			chain:    []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"},
+		},
+		{
+			name:   "forwarded port",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Port":  {"8443"},
+			},
+			clientIP: "198.51.100.7",
+			proto:    "https",
+			host:     "example.com",
+			port:     "8443",
+			chain:    []string{"198.51.100.7", "10.0.0.1"},
+		},
+		{
+			name:   "quoted ipv6 forwarded node",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"Forwarded": {`for="[2001:db8::1]:4711";proto=https;host=shop.example.com`},
+			},
+			clientIP: "2001:db8::1",
+			proto:    "https",
+			host:     "shop.example.com",
+			port:     "443",
+			chain:    []string{"2001:db8::1", "10.0.0.1"},
+		},
+		{
+			name:   "forwarded takes precedence over x-forwarded headers",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"Forwarded":         {"for=198.51.100.9;proto=https;host=a.example"},
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"b.example"},
+				"X-Forwarded-Port":  {"8080"},
+			},
+			clientIP: "198.51.100.9",
+			proto:    "https",
+			host:     "a.example",
+			port:     "443",
+			chain:    []string{"198.51.100.9", "10.0.0.1"},
+		},
+		{
+			name:   "forwarded multi-hop takes proto and host from the client element",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"Forwarded": {
+					"for=192.0.2.60;proto=http;host=spoofed.example, for=198.51.100.17;proto=https;host=a.example",
+					`for="[2001:db8:ffff::2]";proto=http;host=internal`,
+				},
+			},
+			clientIP: "198.51.100.17",
+			proto:    "https",
+			host:     "a.example",
+			port:     "443",
+			chain:    []string{"192.0.2.60", "198.51.100.17", "2001:db8:ffff::2", "10.0.0.1"},
+		},
+		{
+			name:       "untrusted ipv6 peer",
+			remote:     "[2001:db8::5]:5000",
+			clientIP:   "2001:db8::5",
+			clientPort: 5000,
+			proto:      "http",
+			host:       "example.com",
+			port:       "80",
+			chain:      []string{"2001:db8::5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = tt.remote
+			for name, values := range tt.headers {
+				for _, value := range values {
+					r.Header.Add(name, value)
+				}
+			}
+
+			info := newForwardedInfo(r, trusted, false)
+			if info.clientIP != tt.clientIP {
+				t.Errorf("clientIP = %q, want %q", info.clientIP, tt.clientIP)
+			}
+			if info.clientPort != tt.clientPort {
+				t.Errorf("clientPort = %d, want %d", info.clientPort, tt.clientPort)
+			}
+			if info.proto != tt.proto {
+				t.Errorf("proto = %q, want %q", info.proto, tt.proto)
+			}
+			if info.host != tt.host {
+				t.Errorf("host = %q, want %q", info.host, tt.host)
+			}
+			if info.port != tt.port {
+				t.Errorf("port = %q, want %q", info.port, tt.port)
+			}
+			if !slices.Equal(info.chain, tt.chain) {
+				t.Errorf("chain = %q, want %q", info.chain, tt.chain)
+			}
+		})
+	}
+}
+
+func TestForwardedSetHeaders(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("Forwarded", `for="[2001:db8::1]:4711";proto=https`)
+	info := newForwardedInfo(r, trusted, true)
+
+	out := httptest.NewRequest("GET", "http://backend/", nil)
+	out.Header.Set("X-Forwarded-For", "1.2.3.4")
+	info.setHeaders(out)
+
+	want := map[string]string{
+		"X-Forwarded-For":   "2001:db8::1, 10.0.0.1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Port":  "443",
+		"Forwarded":         `for="[2001:db8::1]:4711";proto=https, for=10.0.0.1;host=example.com;proto=http`,
+	}
+	for name, value := range want {
+		if got := out.Header.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	elements := parseForwarded([]string{
+		`for="[2001:db8::1]:4711";proto=https;host="a.example:8443", For=192.0.2.60;by=unknown`,
+		`for="\"quoted,comma\""`,
+	})
+	want := []map[string]string{
+		{"for": "[2001:db8::1]:4711", "proto": "https", "host": "a.example:8443"},
+		{"for": "192.0.2.60", "by": "unknown"},
+		{"for": `"quoted,comma"`},
+	}
+	if len(elements) != len(want) {
+		t.Fatalf("got %d elements, want %d: %v", len(elements), len(want), elements)
+	}
+	for i := range want {
+		for key, value := range want[i] {
+			if elements[i][key] != value {
+				t.Errorf("element %d: %s = %q, want %q", i, key, elements[i][key], value)
+			}
+		}
+		if len(elements[i]) != len(want[i]) {
+			t.Errorf("element %d = %v, want %v", i, elements[i], want[i])
+		}
+	}
+}
+
+func TestClientHop(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hops []string
+		want int
+	}{
+		{nil, -1},
+		{[]string{"198.51.100.7"}, 0},
+		{[]string{"1.2.3.4", "198.51.100.7", "10.0.0.2"}, 1},
+		{[]string{"10.0.0.3", "10.0.0.2"}, 0},
+		{[]string{"10.0.0.3", "198.51.100.7"}, 1},
+		{[]string{"::ffff:10.0.0.3", "not-an-ip"}, 1},
+	}
+	for _, tt := range tests {
+		if got := clientHop(tt.hops, trusted); got != tt.want {
+			t.Errorf("clientHop(%q) = %d, want %d", tt.hops, got, tt.want)
+		}
+	}
+}
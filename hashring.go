@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Hash key sources accepted by the "hash.key" configuration field
+const (
+	HashKeyIP     = "ip"
+	HashKeyHeader = "header"
+	HashKeyCookie = "cookie"
+	HashKeyPath   = "path"
+)
+
+// defaultVirtualNodes is the number of ring points per unit of weight
+const defaultVirtualNodes = 160
+
+// HashRing is a consistent hash ring with virtual nodes.
+// Each backend owns virtualNodes * weight points, so adding or removing
+// a backend only remaps the keys that land on its points (~1/N).
+type HashRing struct {
+	backends []*Backend
+	points   []uint64
+	owners   map[uint64]*Backend
+}
+
+// NewHashRing builds a ring over the given backends
+func NewHashRing(backends []*Backend, virtualNodes int) *HashRing {
+	ring := &HashRing{
+		backends: make([]*Backend, len(backends)),
+		owners:   make(map[uint64]*Backend),
+	}
+	copy(ring.backends, backends)
+
+	for _, backend := range backends {
+		id := backend.URL.String()
+		for i := 0; i < virtualNodes*backend.GetWeight(); i++ {
+			point := hashString(id + "#" + strconv.Itoa(i))
+			// On the (rare) collision the first owner keeps the point
+			if _, exists := ring.owners[point]; exists {
+				continue
+			}
+			ring.owners[point] = backend
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+
+	return ring
+}
+
+// Get returns the first candidate backend clockwise from the key's position
+func (ring *HashRing) Get(key string, r *http.Request) *Backend {
+	if len(ring.points) == 0 {
+		return nil
+	}
+
+	h := hashString(key)
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	for i := 0; i < len(ring.points); i++ {
+		backend := ring.owners[ring.points[(start+i)%len(ring.points)]]
+		if isCandidate(r, backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// matches reports whether the ring was built from exactly these backends
+func (ring *HashRing) matches(backends []*Backend) bool {
+	if len(ring.backends) != len(backends) {
+		return false
+	}
+	for i := range backends {
+		if ring.backends[i] != backends[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ConsistentHashStrategy routes requests with the same key to the same backend
+type ConsistentHashStrategy struct {
+	config HashConfig
+	mu     sync.RWMutex
+	ring   *HashRing
+}
+
+// NewConsistentHashStrategy validates the hash configuration and creates the strategy
+func NewConsistentHashStrategy(config HashConfig) (*ConsistentHashStrategy, error) {
+	switch config.Key {
+	case "":
+		config.Key = HashKeyIP
+	case HashKeyIP, HashKeyPath:
+	case HashKeyHeader, HashKeyCookie:
+		if config.Name == "" {
+			return nil, fmt.Errorf("hash key %s requires a name", config.Key)
+		}
+	default:
+		return nil, fmt.Errorf("unknown hash key: %s", config.Key)
+	}
+
+	if config.Segment < 0 {
+		return nil, fmt.Errorf("invalid hash path segment %d", config.Segment)
+	}
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = defaultVirtualNodes
+	}
+
+	return &ConsistentHashStrategy{config: config}, nil
+}
+
+// Next returns the backend owning the request's hash key
+func (s *ConsistentHashStrategy) Next(backends []*Backend, r *http.Request) *Backend {
+	return s.getRing(backends).Get(s.key(r), r)
+}
+
+// getRing returns the ring for the current backend set, rebuilding it
+// when backends were added or removed
+func (s *ConsistentHashStrategy) getRing(backends []*Backend) *HashRing {
+	s.mu.RLock()
+	ring := s.ring
+	s.mu.RUnlock()
+
+	if ring != nil && ring.matches(backends) {
+		return ring
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ring == nil || !s.ring.matches(backends) {
+		s.ring = NewHashRing(backends, s.config.VirtualNodes)
+	}
+	return s.ring
+}
+
+// key extracts the configured request attribute.
+// Requests missing the attribute fall back to the client IP.
+func (s *ConsistentHashStrategy) key(r *http.Request) string {
+	switch s.config.Key {
+	case HashKeyHeader:
+		if value := r.Header.Get(s.config.Name); value != "" {
+			return value
+		}
+	case HashKeyCookie:
+		if cookie, err := r.Cookie(s.config.Name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	case HashKeyPath:
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if s.config.Segment < len(segments) && segments[s.config.Segment] != "" {
+			return segments[s.config.Segment]
+		}
+	}
+	return clientIP(r)
+}
+
+// hashString hashes a string onto the ring.
+// FNV-1a is finalized with a 64-bit mixer so that similar keys
+// (like "backend#1" and "backend#2") spread evenly around the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// owners maps each of n keys to the backend that owns it on the ring
+func owners(ring *HashRing, n int) []*Backend {
+	r := httptest.NewRequest("GET", "/", nil)
+	owners := make([]*Backend, n)
+	for i := range owners {
+		owners[i] = ring.Get("key-"+strconv.Itoa(i), r)
+	}
+	return owners
+}
+
+func TestHashRingRemapsAboutOneNth(t *testing.T) {
+	const keys = 20000
+	backends := testBackends(t, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
+	before := owners(NewHashRing(backends[:10], defaultVirtualNodes), keys)
+
+	// Adding an eleventh backend only moves keys onto it
+	added := backends[10]
+	after := owners(NewHashRing(backends, defaultVirtualNodes), keys)
+	moved := 0
+	for i := range after {
+		if after[i] != before[i] {
+			moved++
+			if after[i] != added {
+				t.Fatalf("key %d moved between existing backends", i)
+			}
+		}
+	}
+	if share := float64(moved) / keys; share < 0.5/11 || share > 1.5/11 {
+		t.Errorf("adding 1 of 11 backends moved %.3f of keys, want about %.3f", share, 1.0/11)
+	}
+
+	// Removing a backend only moves the keys it owned
+	removed := backends[3]
+	remaining := append(append([]*Backend{}, backends[:3]...), backends[4:10]...)
+	after = owners(NewHashRing(remaining, defaultVirtualNodes), keys)
+	moved = 0
+	for i := range after {
+		if before[i] == removed {
+			moved++
+		} else if after[i] != before[i] {
+			t.Fatalf("key %d moved off a backend that stayed", i)
+		}
+	}
+	if share := float64(moved) / keys; share < 0.5/10 || share > 1.5/10 {
+		t.Errorf("removed backend owned %.3f of keys, want about %.3f", share, 1.0/10)
+	}
+}
+
+func TestHashRingWeights(t *testing.T) {
+	const keys = 20000
+	backends := testBackends(t, 3, 1)
+	counts := make(map[*Backend]int)
+	for _, owner := range owners(NewHashRing(backends, defaultVirtualNodes), keys) {
+		counts[owner]++
+	}
+	if share := float64(counts[backends[0]]) / keys; share < 0.65 || share > 0.85 {
+		t.Errorf("weight 3 of 4 owns %.3f of keys, want about 0.75", share)
+	}
+}
+
+// A key whose owner is down moves to the next backend on the ring and
+// comes back once it recovers
+func TestHashRingSkipsUnavailableOwner(t *testing.T) {
+	backends := testBackends(t, 1, 1, 1)
+	ring := NewHashRing(backends, defaultVirtualNodes)
+	before := owners(ring, 1000)
+
+	down := backends[1]
+	down.SetAlive(false)
+	for i, owner := range owners(ring, 1000) {
+		switch {
+		case owner == down:
+			t.Fatalf("key %d sent to an unavailable backend", i)
+		case before[i] != down && owner != before[i]:
+			t.Fatalf("key %d moved although its owner is up", i)
+		}
+	}
+
+	down.SetAlive(true)
+	for i, owner := range owners(ring, 1000) {
+		if owner != before[i] {
+			t.Fatalf("key %d did not return to its owner", i)
+		}
+	}
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HashConfig
+		path   string
+		header http.Header
+		want   string
+	}{
+		{name: "ip", config: HashConfig{Key: HashKeyIP}, want: "192.0.2.1"},
+		{name: "default is ip", want: "192.0.2.1"},
+		{name: "header", config: HashConfig{Key: HashKeyHeader, Name: "X-User"}, header: http.Header{"X-User": {"alice"}}, want: "alice"},
+		{name: "missing header", config: HashConfig{Key: HashKeyHeader, Name: "X-User"}, want: "192.0.2.1"},
+		{name: "cookie", config: HashConfig{Key: HashKeyCookie, Name: "session"}, header: http.Header{"Cookie": {"theme=dark; session=abc123"}}, want: "abc123"},
+		{name: "missing cookie", config: HashConfig{Key: HashKeyCookie, Name: "session"}, header: http.Header{"Cookie": {"theme=dark"}}, want: "192.0.2.1"},
+		{name: "empty cookie", config: HashConfig{Key: HashKeyCookie, Name: "session"}, header: http.Header{"Cookie": {"session="}}, want: "192.0.2.1"},
+		{name: "path", config: HashConfig{Key: HashKeyPath}, path: "/tenants/acme/orders", want: "tenants"},
+		{name: "path segment", config: HashConfig{Key: HashKeyPath, Segment: 1}, path: "/tenants/acme/orders", want: "acme"},
+		{name: "path segment past the end", config: HashConfig{Key: HashKeyPath, Segment: 3}, path: "/tenants/acme/orders", want: "192.0.2.1"},
+		{name: "empty path segment", config: HashConfig{Key: HashKeyPath, Segment: 1}, path: "/tenants//orders", want: "192.0.2.1"},
+		{name: "root path", config: HashConfig{Key: HashKeyPath}, path: "/", want: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewConsistentHashStrategy(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := tt.path
+			if path == "" {
+				path = "/"
+			}
+			r := httptest.NewRequest("GET", path, nil)
+			r.RemoteAddr = "192.0.2.1:51234"
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if got := s.key(r); got != tt.want {
+				t.Errorf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewConsistentHashStrategy(t *testing.T) {
+	for _, config := range []HashConfig{
+		{Key: HashKeyHeader},
+		{Key: HashKeyCookie},
+		{Key: "query"},
+		{Key: HashKeyPath, Segment: -1},
+	} {
+		if _, err := NewConsistentHashStrategy(config); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+
+	s, err := NewConsistentHashStrategy(HashConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.config.Key != HashKeyIP || s.config.VirtualNodes != defaultVirtualNodes {
+		t.Errorf("defaults = %+v", s.config)
+	}
+
+	// The ring is rebuilt only when the backend set changes
+	backends := testBackends(t, 1, 1)
+	ring := s.getRing(backends)
+	if s.getRing(backends) != ring {
+		t.Error("ring rebuilt for the same backends")
+	}
+	if s.getRing(backends[:1]) == ring {
+		t.Error("ring kept after a backend was removed")
+	}
+}
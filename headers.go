@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders accepted in header rule values
+var headerVariables = map[string]bool{
+	"client_ip":        true,
+	"remote_addr":      true,
+	"request_id":       true,
+	"request_start_ms": true,
+	"request_start_us": true,
+	"host":             true,
+	"method":           true,
+	"path":             true,
+	"scheme":           true,
+	"pool":             true,
+	"route":            true,
+	"backend_url":      true,
+	"backend_host":     true,
+}
+
+/*
+ * @ HeaderRules holds the compiled header manipulations of a pool
+ * or route. Removals are applied first, then sets, then appends
+ */
+type HeaderRules struct {
+	request  headerOps
+	response headerOps
+}
+
+type headerOps struct {
+	set    []headerValue
+	add    []headerValue
+	remove []string
+}
+
+// headerValue is a header name with a parsed value template
+type headerValue struct {
+	name  string
+	value []templatePart
+}
+
+// templatePart is either literal text or a {variable} reference
+type templatePart struct {
+	text     string
+	variable string
+}
+
+// NewHeaderRules compiles header rules, returning nil when none are configured
+func NewHeaderRules(config HeaderRulesConfig) (*HeaderRules, error) {
+	request, err := compileHeaderOps(config.Request)
+	if err != nil {
+		return nil, fmt.Errorf("request header rules: %w", err)
+	}
+	response, err := compileHeaderOps(config.Response)
+	if err != nil {
+		return nil, fmt.Errorf("response header rules: %w", err)
+	}
+	if request.empty() && response.empty() {
+		return nil, nil
+	}
+	return &HeaderRules{request: request, response: response}, nil
+}
+
+func compileHeaderOps(config HeaderOpsConfig) (headerOps, error) {
+	var ops headerOps
+	for name, value := range config.Set {
+		parts, err := parseHeaderTemplate(value)
+		if err != nil {
+			return ops, fmt.Errorf("header %s: %w", name, err)
+		}
+		ops.set = append(ops.set, headerValue{name: http.CanonicalHeaderKey(name), value: parts})
+	}
+	for name, value := range config.Add {
+		parts, err := parseHeaderTemplate(value)
+		if err != nil {
+			return ops, fmt.Errorf("header %s: %w", name, err)
+		}
+		ops.add = append(ops.add, headerValue{name: http.CanonicalHeaderKey(name), value: parts})
+	}
+	for _, name := range config.Remove {
+		ops.remove = append(ops.remove, http.CanonicalHeaderKey(name))
+	}
+	return ops, nil
+}
+
+func (ops headerOps) empty() bool {
+	return len(ops.set) == 0 && len(ops.add) == 0 && len(ops.remove) == 0
+}
+
+// parseHeaderTemplate splits a value like "t={request_start_us}" into parts
+func parseHeaderTemplate(s string) ([]templatePart, error) {
+	var parts []templatePart
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			parts = append(parts, templatePart{text: s})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, templatePart{text: s[:open]})
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in %q", s)
+		}
+		name := s[open+1 : open+end]
+		if !headerVariables[name] {
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		parts = append(parts, templatePart{variable: name})
+		s = s[open+end+1:]
+	}
+	return parts, nil
+}
+
+// requestInfo is per-request state shared by every proxy attempt
+type requestInfo struct {
+	id        string
+	start     time.Time
+	route     *Route
+	forwarded *forwardedInfo
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo attaches request state to the request context. The
+// request ID is taken from X-Request-Id when the client sent one.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{
+		id:    r.Header.Get("X-Request-Id"),
+		start: time.Now(),
+	}
+	if info.id == "" {
+		info.id = newRequestID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// newRequestID returns a random 128-bit hex identifier
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// headerRewrite applies the pool and route header rules of one attempt
+type headerRewrite struct {
+	rules   []*HeaderRules
+	request *http.Request
+	backend *Backend
+	pool    string
+	info    *requestInfo
+}
+
+// variable resolves a template placeholder
+func (h *headerRewrite) variable(name string) string {
+	r := h.request
+	switch name {
+	case "client_ip":
+		return clientIP(r)
+	case "remote_addr":
+		return r.RemoteAddr
+	case "request_id":
+		if h.info != nil {
+			return h.info.id
+		}
+	case "request_start_ms":
+		if h.info != nil {
+			return strconv.FormatInt(h.info.start.UnixMilli(), 10)
+		}
+	case "request_start_us":
+		if h.info != nil {
+			return strconv.FormatInt(h.info.start.UnixMicro(), 10)
+		}
+	case "host":
+		return r.Host
+	case "method":
+		return r.Method
+	case "path":
+		return r.URL.Path
+	case "scheme":
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	case "pool":
+		return h.pool
+	case "route":
+		if h.info != nil && h.info.route != nil {
+			return h.info.route.name
+		}
+	case "backend_url":
+		return h.backend.URL.String()
+	case "backend_host":
+		return h.backend.URL.Host
+	}
+	return ""
+}
+
+func (h *headerRewrite) expand(parts []templatePart) string {
+	var b strings.Builder
+	for _, part := range parts {
+		if part.variable != "" {
+			b.WriteString(h.variable(part.variable))
+		} else {
+			b.WriteString(part.text)
+		}
+	}
+	return b.String()
+}
+
+// apply runs one set of operations against a header map. Setting
+// "Host" on a request changes the request host instead of the map.
+func (h *headerRewrite) apply(ops headerOps, header http.Header, r *http.Request) {
+	for _, name := range ops.remove {
+		header.Del(name)
+	}
+	for _, hv := range ops.set {
+		if hv.name == "Host" && r != nil {
+			r.Host = h.expand(hv.value)
+			continue
+		}
+		header.Set(hv.name, h.expand(hv.value))
+	}
+	for _, hv := range ops.add {
+		header.Add(hv.name, h.expand(hv.value))
+	}
+}
+
+// Request rewrites the headers of the outgoing request
+func (h *headerRewrite) Request(r *http.Request) {
+	for _, rules := range h.rules {
+		h.apply(rules.request, r.Header, r)
+	}
+}
+
+// Response rewrites the headers sent back to the client
+func (h *headerRewrite) Response(header http.Header) {
+	for _, rules := range h.rules {
+		h.apply(rules.response, header, nil)
+	}
+}
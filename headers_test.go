@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseHeaderTemplate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []templatePart
+		err  bool
+	}{
+		{in: "", want: nil},
+		{in: "static", want: []templatePart{{text: "static"}}},
+		{in: "{client_ip}", want: []templatePart{{variable: "client_ip"}}},
+		{in: "t={request_start_us}", want: []templatePart{{text: "t="}, {variable: "request_start_us"}}},
+		{in: "{scheme}://{host}{path}", want: []templatePart{{variable: "scheme"}, {text: "://"}, {variable: "host"}, {variable: "path"}}},
+		{in: "a}b", want: []templatePart{{text: "a}b"}}},
+		{in: "{client}", err: true},
+		{in: "{}", err: true},
+		{in: "x={host", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseHeaderTemplate(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseHeaderTemplate(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHeaderTemplate(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewHeaderRules(t *testing.T) {
+	rules, err := NewHeaderRules(HeaderRulesConfig{})
+	if rules != nil || err != nil {
+		t.Errorf("empty rules = %v, %v, want nil", rules, err)
+	}
+	if _, err := NewHeaderRules(HeaderRulesConfig{Response: HeaderOpsConfig{Add: map[string]string{"X-Id": "{id}"}}}); err == nil {
+		t.Error("unknown placeholder accepted")
+	}
+	rules, err = NewHeaderRules(HeaderRulesConfig{Request: HeaderOpsConfig{Remove: []string{"x-internal"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rules.request.remove, []string{"X-Internal"}) {
+		t.Errorf("remove = %v, want canonical names", rules.request.remove)
+	}
+}
+
+func TestHeaderVariables(t *testing.T) {
+	start := time.UnixMicro(1700000000123456)
+	backend := testBackends(t, 1)[0]
+	r := httptest.NewRequest("POST", "https://shop.example.com/cart?item=1", nil)
+	r.RemoteAddr = "192.0.2.7:40000"
+	route, err := NewRoute(RouteConfig{Name: "cart", Pool: "shop"}, map[string]*Pool{"shop": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &headerRewrite{
+		request: r,
+		backend: backend,
+		pool:    "shop",
+		info:    &requestInfo{id: "req-1", start: start, route: route},
+	}
+
+	want := map[string]string{
+		"client_ip":        "192.0.2.7",
+		"remote_addr":      "192.0.2.7:40000",
+		"request_id":       "req-1",
+		"request_start_ms": strconv.FormatInt(start.UnixMilli(), 10),
+		"request_start_us": "1700000000123456",
+		"host":             "shop.example.com",
+		"method":           "POST",
+		"path":             "/cart",
+		"scheme":           "https",
+		"pool":             "shop",
+		"route":            "cart",
+		"backend_url":      "http://a.test:8080",
+		"backend_host":     "a.test:8080",
+	}
+	for name := range headerVariables {
+		if _, ok := want[name]; !ok {
+			t.Errorf("placeholder {%s} is not covered", name)
+		}
+	}
+	for name, value := range want {
+		if got := h.variable(name); got != value {
+			t.Errorf("{%s} = %q, want %q", name, got, value)
+		}
+	}
+
+	// Without request state the per-request placeholders are empty
+	r.TLS = nil
+	h.info = nil
+	for name, value := range map[string]string{"request_id": "", "request_start_ms": "", "route": "", "scheme": "http"} {
+		if got := h.variable(name); got != value {
+			t.Errorf("{%s} without request state = %q, want %q", name, got, value)
+		}
+	}
+
+	parts, _ := parseHeaderTemplate("{method} {scheme}://{host}{path} from {client_ip}")
+	if got := h.expand(parts); got != "POST http://shop.example.com/cart from 192.0.2.7" {
+		t.Errorf("expand = %q", got)
+	}
+}
+
+func TestHeaderRulesOrder(t *testing.T) {
+	pool, err := NewHeaderRules(HeaderRulesConfig{
+		Request: HeaderOpsConfig{
+			Remove: []string{"X-Forwarded-User", "X-Tier"},
+			Set:    map[string]string{"x-tier": "pool", "X-Env": "prod"},
+			Add:    map[string]string{"X-Forwarded-User": "anonymous", "X-Env": "eu"},
+		},
+		Response: HeaderOpsConfig{
+			Remove: []string{"Server"},
+			Set:    map[string]string{"Host": "ignored.example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := NewHeaderRules(HeaderRulesConfig{
+		Request: HeaderOpsConfig{
+			Set: map[string]string{"X-Tier": "route", "Host": "{pool}.internal"},
+			Add: map[string]string{"X-Tier": "canary"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://shop.example.com/", nil)
+	r.Header.Set("X-Forwarded-User", "admin")
+	r.Header.Set("X-Tier", "client")
+	h := &headerRewrite{rules: []*HeaderRules{pool, route}, request: r, backend: testBackends(t, 1)[0], pool: "shop"}
+
+	out := r.Clone(r.Context())
+	h.Request(out)
+	want := http.Header{
+		// Removed before the add, so the client's value is gone
+		"X-Forwarded-User": {"anonymous"},
+		// Set, then appended to
+		"X-Env": {"prod", "eu"},
+		// The route's rules run after the pool's
+		"X-Tier": {"route", "canary"},
+	}
+	for name, values := range want {
+		if got := out.Header.Values(name); !reflect.DeepEqual(got, values) {
+			t.Errorf("%s = %q, want %q", name, got, values)
+		}
+	}
+	if out.Host != "shop.internal" || out.Header.Get("Host") != "" {
+		t.Errorf("host = %q, header %q, want the request host rewritten", out.Host, out.Header.Get("Host"))
+	}
+	// The client's request is not modified
+	if r.Header.Get("X-Tier") != "client" || r.Host != "shop.example.com" {
+		t.Error("incoming request modified")
+	}
+
+	// Host is an ordinary header in responses
+	header := http.Header{"Server": {"nginx"}, "Content-Type": {"text/plain"}}
+	h.Response(header)
+	if header.Get("Server") != "" || header.Get("Host") != "ignored.example.com" || header.Get("Content-Type") != "text/plain" {
+		t.Errorf("response headers = %v", header)
+	}
+}
+
+// Rules reach the backend and the client through the proxy
+func TestPoolHeaderRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Id", r.Header.Get("X-Request-Id"))
+		w.Header().Set("X-Seen-Scheme", r.Header.Get("X-Scheme"))
+		w.Header().Set("Server", "backend")
+	}))
+	defer backend.Close()
+
+	pool, err := NewPool("web", PoolConfig{
+		HeaderRules: HeaderRulesConfig{
+			Request:  HeaderOpsConfig{Set: map[string]string{"X-Request-Id": "{request_id}", "X-Scheme": "{scheme}"}},
+			Response: HeaderOpsConfig{Remove: []string{"Server"}, Set: map[string]string{"X-Pool": "{pool}"}},
+		},
+		Backends: []BackendConfig{{URL: backend.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "https://shop.example.com/", nil)
+	r.TLS = &tls.ConnectionState{}
+	r.Header.Set("X-Request-Id", "client-id")
+	r, _ = withRequestInfo(r)
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, r)
+
+	res := w.Result()
+	for name, value := range map[string]string{"X-Seen-Id": "client-id", "X-Seen-Scheme": "https", "X-Pool": "web", "Server": ""} {
+		if got := res.Header.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
@@ -2,30 +2,250 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
 	"log"
-	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Health check defaults
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	maxHealthCheckBody         = 64 * 1024
+)
+
+/*
+ * @ HealthCheck is the resolved health check definition of a backend
+ * built from the pool settings with per-backend overrides applied
+ */
+type HealthCheck struct {
+	Type        string
+	Path        string
+	Port        int
+	Host        string
+	Headers     map[string]string
+	Timeout     time.Duration
+	Rise        int
+	Fall        int
+	ServerName  string
+	SkipVerify  bool
+	GRPCService string
+	Send        []byte
+
+	statuses  []statusRange
+	body      string
+	bodyRegex *regexp.Regexp
+}
+
+// statusRange is an inclusive range of accepted status codes
+type statusRange struct {
+	min, max int
+}
+
+// NewHealthCheck merges a backend override onto the pool settings and
+// validates the result
+func NewHealthCheck(pool HealthCheckConfig, override *HealthCheckConfig) (*HealthCheck, error) {
+	config := pool
+	if override != nil {
+		config = mergeHealthCheck(pool, *override)
+	}
+
+	hc := &HealthCheck{
+		Type:        config.Type,
+		Path:        config.Path,
+		Port:        config.Port,
+		Host:        config.Host,
+		Headers:     config.Headers,
+		Timeout:     time.Duration(config.Timeout) * time.Second,
+		Rise:        config.Rise,
+		Fall:        config.Fall,
+		ServerName:  config.ServerName,
+		SkipVerify:  config.SkipVerify,
+		GRPCService: config.GRPCService,
+		body:        config.ExpectedBody,
+	}
+	if hc.Type == "" {
+		hc.Type = HealthCheckHTTP
+	}
+	if _, ok := probers[hc.Type]; !ok {
+		return nil, fmt.Errorf("unknown health check type: %s", hc.Type)
+	}
+	hc.Send = []byte(config.Send)
+	if config.SendHex != "" {
+		payload, err := hex.DecodeString(config.SendHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check send_hex: %w", err)
+		}
+		hc.Send = payload
+	}
+	if hc.Port < 0 || hc.Port > 65535 {
+		return nil, fmt.Errorf("invalid health check port %d", hc.Port)
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultHealthCheckTimeout
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = 1
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = 1
+	}
+
+	statuses := config.ExpectedStatuses
+	if len(statuses) == 0 {
+		statuses = []string{"2xx"}
+	}
+	for _, status := range statuses {
+		r, err := parseStatusRange(status)
+		if err != nil {
+			return nil, err
+		}
+		hc.statuses = append(hc.statuses, r)
+	}
+
+	if config.ExpectedBodyRegex != "" {
+		re, err := regexp.Compile(config.ExpectedBodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check body regex: %w", err)
+		}
+		hc.bodyRegex = re
+	}
+
+	return hc, nil
+}
+
+// mergeHealthCheck overlays the fields set in override onto base
+func mergeHealthCheck(base, override HealthCheckConfig) HealthCheckConfig {
+	if override.Type != "" {
+		base.Type = override.Type
+	}
+	if override.Path != "" {
+		base.Path = override.Path
+	}
+	if override.Port > 0 {
+		base.Port = override.Port
+	}
+	if override.ServerName != "" {
+		base.ServerName = override.ServerName
+	}
+	if override.SkipVerify {
+		base.SkipVerify = true
+	}
+	if override.GRPCService != "" {
+		base.GRPCService = override.GRPCService
+	}
+	if override.Send != "" || override.SendHex != "" {
+		base.Send = override.Send
+		base.SendHex = override.SendHex
+	}
+	if override.Timeout > 0 {
+		base.Timeout = override.Timeout
+	}
+	if len(override.ExpectedStatuses) > 0 {
+		base.ExpectedStatuses = override.ExpectedStatuses
+	}
+	if override.ExpectedBody != "" {
+		base.ExpectedBody = override.ExpectedBody
+	}
+	if override.ExpectedBodyRegex != "" {
+		base.ExpectedBodyRegex = override.ExpectedBodyRegex
+	}
+	if override.Host != "" {
+		base.Host = override.Host
+	}
+	if len(override.Headers) > 0 {
+		headers := make(map[string]string, len(base.Headers)+len(override.Headers))
+		for k, v := range base.Headers {
+			headers[k] = v
+		}
+		for k, v := range override.Headers {
+			headers[k] = v
+		}
+		base.Headers = headers
+	}
+	if override.Rise > 0 {
+		base.Rise = override.Rise
+	}
+	if override.Fall > 0 {
+		base.Fall = override.Fall
+	}
+	return base
+}
+
+// parseStatusRange parses "200", "2xx" or "200-399"
+func parseStatusRange(s string) (statusRange, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+		base := int(s[0]-'0') * 100
+		return statusRange{base, base + 99}, nil
+	}
+	if lo, hi, found := strings.Cut(s, "-"); found {
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || min > max {
+			return statusRange{}, fmt.Errorf("invalid health check status range: %s", s)
+		}
+		return statusRange{min, max}, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid health check status: %s", s)
+	}
+	return statusRange{code, code}, nil
+}
+
+// expectsStatus reports whether the status code counts as healthy
+func (h *HealthCheck) expectsStatus(code int) bool {
+	for _, r := range h.statuses {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// needsBody reports whether the response body has to be inspected
+func (h *HealthCheck) needsBody() bool {
+	return h.body != "" || h.bodyRegex != nil
+}
+
+// matchesBody reports whether the response body satisfies the expectations
+func (h *HealthCheck) matchesBody(body []byte) bool {
+	if h.body != "" && !strings.Contains(string(body), h.body) {
+		return false
+	}
+	if h.bodyRegex != nil && !h.bodyRegex.Match(body) {
+		return false
+	}
+	return true
+}
+
 /*
  * @ HealthChecker periodically checks the health of backend servers
  */
 type HealthChecker struct {
 	backends []*Backend
-	path     string
 	interval time.Duration
+	reset    chan time.Duration
 	mu       sync.RWMutex
 }
 
 /*
  * @ NewHealthChecker creates a new health checker
  */
-func NewHealthChecker(backends []*Backend, path string, interval time.Duration) *HealthChecker {
+func NewHealthChecker(backends []*Backend, interval time.Duration) *HealthChecker {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
 	return &HealthChecker{
 		backends: backends,
-		path:     path,
 		interval: interval,
+		reset:    make(chan time.Duration, 1),
 	}
 }
 
@@ -33,7 +253,9 @@ func NewHealthChecker(backends []*Backend, path string, interval time.Duration)
  * @ Start begins the health check routine
  */
 func (hc *HealthChecker) Start(ctx context.Context) {
+	hc.mu.RLock()
 	ticker := time.NewTicker(hc.interval)
+	hc.mu.RUnlock()
 	defer ticker.Stop()
 
 	// Perform initial health check
@@ -43,12 +265,35 @@ func (hc *HealthChecker) Start(ctx context.Context) {
 		select {
 		case <-ticker.C:
 			hc.checkAll()
+		case interval := <-hc.reset:
+			ticker.Reset(interval)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// SetInterval changes how often backends are checked
+func (hc *HealthChecker) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if interval == hc.interval {
+		return
+	}
+	hc.interval = interval
+
+	// Only the latest interval matters if the checker has not picked up the last one
+	select {
+	case <-hc.reset:
+	default:
+	}
+	hc.reset <- interval
+}
+
 // checkAll checks the health of all backends
 func (hc *HealthChecker) checkAll() {
 	hc.mu.RLock()
@@ -84,34 +329,23 @@ func (hc *HealthChecker) RemoveBackend(backend *Backend) {
 	}
 }
 
-// check performs a health check on a single backend
+// check performs a health check on a single backend and applies the
+// rise/fall thresholds to the result
 func (hc *HealthChecker) check(backend *Backend) {
-	url := backend.URL.String() + hc.path
-
-	// Validate URL scheme to prevent SSRF attacks
-	if backend.URL.Scheme != "http" && backend.URL.Scheme != "https" {
-		backend.SetAlive(false)
-		log.Printf("Backend %s has invalid scheme: %s", backend.URL.String(), backend.URL.Scheme)
-		return
-	}
-
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
+	check := backend.HealthCheck()
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
 
-	resp, err := client.Get(url)
+	err := probers[check.Type].Probe(ctx, backend, check)
 	if err != nil {
-		backend.SetAlive(false)
-		log.Printf("Backend %s is DOWN: %v", backend.URL.String(), err)
-		return
+		log.Printf("Backend %s check failed: %v", backend.URL.String(), err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		backend.SetAlive(true)
-		log.Printf("Backend %s is UP", backend.URL.String())
-	} else {
-		backend.SetAlive(false)
-		log.Printf("Backend %s is DOWN (status %d)", backend.URL.String(), resp.StatusCode)
+	if changed, alive := backend.ReportHealth(err == nil); changed {
+		if alive {
+			log.Printf("Backend %s is UP", backend.URL.String())
+		} else {
+			log.Printf("Backend %s is DOWN", backend.URL.String())
+		}
 	}
 }
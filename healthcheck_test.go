@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// testBackend creates a backend for the URL with the given health check
+func testBackend(t *testing.T, url string, config HealthCheckConfig) *Backend {
+	t.Helper()
+	backend, err := NewBackend(BackendConfig{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, err := NewHealthCheck(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.SetHealthCheck(check)
+	return backend
+}
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want statusRange
+		err  bool
+	}{
+		{in: "200", want: statusRange{200, 200}},
+		{in: "2xx", want: statusRange{200, 299}},
+		{in: "5XX", want: statusRange{500, 599}},
+		{in: " 3xx ", want: statusRange{300, 399}},
+		{in: "200-399", want: statusRange{200, 399}},
+		{in: "404-404", want: statusRange{404, 404}},
+		{in: "399-200", err: true},
+		{in: "6xx", err: true},
+		{in: "2x", err: true},
+		{in: "200-", err: true},
+		{in: "ok", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStatusRange(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseStatusRange(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("parseStatusRange(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewHealthCheck(t *testing.T) {
+	check, err := NewHealthCheck(HealthCheckConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Type != HealthCheckHTTP || check.Timeout != defaultHealthCheckTimeout || check.Rise != 1 || check.Fall != 1 {
+		t.Errorf("defaults = %+v", check)
+	}
+	for code, want := range map[int]bool{199: false, 200: true, 204: true, 299: true, 301: false, 503: false} {
+		if got := check.expectsStatus(code); got != want {
+			t.Errorf("default check accepts %d = %v, want %v", code, got, want)
+		}
+	}
+
+	check, err = NewHealthCheck(HealthCheckConfig{ExpectedStatuses: []string{"200", "3xx", "401-403"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[int]bool{200: true, 204: false, 302: true, 400: false, 401: true, 403: true, 404: false} {
+		if got := check.expectsStatus(code); got != want {
+			t.Errorf("check accepts %d = %v, want %v", code, got, want)
+		}
+	}
+
+	for _, config := range []HealthCheckConfig{
+		{Type: "icmp"},
+		{ExpectedStatuses: []string{"2xx", "teapot"}},
+		{ExpectedBodyRegex: "("},
+		{SendHex: "zz"},
+		{Port: 70000},
+	} {
+		if _, err := NewHealthCheck(config, nil); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+}
+
+func TestHealthCheckOverride(t *testing.T) {
+	pool := HealthCheckConfig{
+		Path:             "/health",
+		ExpectedStatuses: []string{"200"},
+		Headers:          map[string]string{"X-Check": "pool", "X-Pool": "yes"},
+		Rise:             2,
+	}
+	check, err := NewHealthCheck(pool, &HealthCheckConfig{
+		Path:    "/ready",
+		Headers: map[string]string{"X-Check": "backend"},
+		Fall:    3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Path != "/ready" || check.Rise != 2 || check.Fall != 3 {
+		t.Errorf("merged check = %+v", check)
+	}
+	if check.Headers["X-Check"] != "backend" || check.Headers["X-Pool"] != "yes" {
+		t.Errorf("merged headers = %v", check.Headers)
+	}
+	if !check.expectsStatus(200) || check.expectsStatus(204) {
+		t.Error("pool statuses not kept")
+	}
+	// The pool's headers are not modified by the override
+	if pool.Headers["X-Check"] != "pool" {
+		t.Errorf("pool headers changed to %v", pool.Headers)
+	}
+}
+
+func TestHealthCheckBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HealthCheckConfig
+		body   string
+		want   bool
+	}{
+		{name: "no expectation", body: "anything", want: true},
+		{name: "substring", config: HealthCheckConfig{ExpectedBody: `"status":"ok"`}, body: `{"status":"ok","db":"up"}`, want: true},
+		{name: "substring missing", config: HealthCheckConfig{ExpectedBody: `"status":"ok"`}, body: `{"status":"degraded"}`},
+		{name: "regex", config: HealthCheckConfig{ExpectedBodyRegex: `^ok( \d+)?$`}, body: "ok 42", want: true},
+		{name: "regex mismatch", config: HealthCheckConfig{ExpectedBodyRegex: `^ok$`}, body: "not ok"},
+		{name: "both", config: HealthCheckConfig{ExpectedBody: "db:up", ExpectedBodyRegex: `^status:`}, body: "status: db:up", want: true},
+		{name: "both, regex fails", config: HealthCheckConfig{ExpectedBody: "db:up", ExpectedBodyRegex: `^status:`}, body: "db:up"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+
+			backend := testBackend(t, server.URL, tt.config)
+			err := HTTPProber{}.Probe(context.Background(), backend, backend.HealthCheck())
+			if (err == nil) != tt.want {
+				t.Errorf("probe error = %v, want healthy %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPProberRequest(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" || r.Host != "app.internal" || r.Header.Get("X-Check") != "1" {
+			t.Errorf("probe request %s host %s header %q", r.URL.Path, r.Host, r.Header.Get("X-Check"))
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	backend := testBackend(t, server.URL, HealthCheckConfig{
+		Path:             "/ready",
+		Host:             "app.internal",
+		Headers:          map[string]string{"X-Check": "1"},
+		ExpectedStatuses: []string{"200", "429"},
+	})
+	for code, healthy := range map[int64]bool{200: true, 429: true, 204: false, 503: false} {
+		status.Store(code)
+		err := HTTPProber{}.Probe(context.Background(), backend, backend.HealthCheck())
+		if (err == nil) != healthy {
+			t.Errorf("status %d: probe error = %v, want healthy %v", code, err, healthy)
+		}
+	}
+}
+
+func TestHealthCheckRiseFall(t *testing.T) {
+	backend := testBackend(t, "http://10.0.0.1:8080", HealthCheckConfig{Rise: 2, Fall: 3})
+
+	steps := []struct {
+		healthy bool
+		alive   bool
+		changed bool
+	}{
+		{false, true, false},
+		{false, true, false},
+		{true, true, false}, // a success resets the failure count
+		{false, true, false},
+		{false, true, false},
+		{false, false, true},
+		{false, false, false},
+		{true, false, false},
+		{false, false, false}, // a failure resets the success count
+		{true, false, false},
+		{true, true, true},
+		{true, true, false},
+	}
+	for i, step := range steps {
+		changed, alive := backend.ReportHealth(step.healthy)
+		if changed != step.changed || alive != step.alive {
+			t.Fatalf("step %d (healthy %v): changed %v alive %v, want %v %v", i, step.healthy, changed, alive, step.changed, step.alive)
+		}
+	}
+
+	// Replacing the check starts counting afresh
+	backend.ReportHealth(false)
+	backend.SetHealthCheck(backend.HealthCheck())
+	backend.ReportHealth(false)
+	backend.ReportHealth(false)
+	if !backend.IsAlive() {
+		t.Error("failures counted across a health check change")
+	}
+}
+
+// The checker applies the thresholds to real probe results
+func TestHealthCheckerThresholds(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	backend := testBackend(t, server.URL, HealthCheckConfig{Rise: 2, Fall: 2})
+	checker := NewHealthChecker([]*Backend{backend}, 0)
+
+	checker.check(backend)
+	if !backend.IsAlive() {
+		t.Fatal("one failure took the backend down with fall 2")
+	}
+	checker.check(backend)
+	if backend.IsAlive() {
+		t.Fatal("two failures did not take the backend down")
+	}
+
+	healthy.Store(true)
+	checker.check(backend)
+	if backend.IsAlive() {
+		t.Fatal("one success brought the backend up with rise 2")
+	}
+	checker.check(backend)
+	if !backend.IsAlive() {
+		t.Fatal("two successes did not bring the backend up")
+	}
+}
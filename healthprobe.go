@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Health check types accepted by the "health_check.type" configuration field
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+	HealthCheckTLS  = "tls"
+	HealthCheckGRPC = "grpc"
+	HealthCheckUDP  = "udp"
+)
+
+// Prober performs a single active health check against a backend
+type Prober interface {
+	Probe(ctx context.Context, backend *Backend, check *HealthCheck) error
+}
+
+// probers maps health check types to their implementation
+var probers = map[string]Prober{
+	HealthCheckHTTP: HTTPProber{},
+	HealthCheckTCP:  TCPProber{},
+	HealthCheckTLS:  TLSProber{},
+	HealthCheckGRPC: GRPCProber{},
+	HealthCheckUDP:  UDPProber{},
+}
+
+// probeAddress returns the host:port a health check connects to.
+// The check port overrides the backend URL port.
+func probeAddress(backend *Backend, check *HealthCheck) string {
+	port := backend.URL.Port()
+	if check.Port > 0 {
+		port = strconv.Itoa(check.Port)
+	}
+	if port == "" {
+		switch backend.URL.Scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(backend.URL.Hostname(), port)
+}
+
+// probeServerName returns the TLS server name used by a health check
+func probeServerName(backend *Backend, check *HealthCheck) string {
+	if check.ServerName != "" {
+		return check.ServerName
+	}
+	if check.Host != "" {
+		return check.Host
+	}
+	if backend.tlsConfig != nil && backend.tlsConfig.ServerName != "" {
+		return backend.tlsConfig.ServerName
+	}
+	return backend.URL.Hostname()
+}
+
+// probeTLSConfig returns the TLS client settings of a health check,
+// starting from the pool's upstream TLS so client certificates are sent
+func probeTLSConfig(backend *Backend, check *HealthCheck) *tls.Config {
+	config := &tls.Config{}
+	if backend.tlsConfig != nil {
+		config = backend.tlsConfig.Clone()
+	}
+	config.ServerName = probeServerName(backend, check)
+	if check.SkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+// HTTPProber sends a GET request and validates status and body
+type HTTPProber struct{}
+
+func (HTTPProber) Probe(ctx context.Context, backend *Backend, check *HealthCheck) error {
+	// Validate URL scheme to prevent SSRF attacks
+	if backend.URL.Scheme != "http" && backend.URL.Scheme != "https" {
+		return fmt.Errorf("invalid scheme: %s", backend.URL.Scheme)
+	}
+
+	target := *backend.URL
+	if check.Port > 0 {
+		target.Host = probeAddress(backend, check)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String()+check.Path, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range check.Headers {
+		req.Header.Set(name, value)
+	}
+	if check.Host != "" {
+		req.Host = check.Host
+	}
+
+	transport := &http.Transport{
+		DialContext:     backend.dialContext,
+		TLSClientConfig: probeTLSConfig(backend, check),
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !check.expectsStatus(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if check.needsBody() {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+		if err != nil {
+			return err
+		}
+		if !check.matchesBody(body) {
+			return fmt.Errorf("response body does not match")
+		}
+	}
+
+	return nil
+}
+
+// TCPProber considers a backend healthy if a TCP connection can be opened
+type TCPProber struct{}
+
+func (TCPProber) Probe(ctx context.Context, backend *Backend, check *HealthCheck) error {
+	conn, err := backend.dialContext(ctx, "tcp", probeAddress(backend, check))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// TLSProber considers a backend healthy if a TLS handshake completes
+type TLSProber struct{}
+
+func (TLSProber) Probe(ctx context.Context, backend *Backend, check *HealthCheck) error {
+	raw, err := backend.dialContext(ctx, "tcp", probeAddress(backend, check))
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(raw, probeTLSConfig(backend, check))
+	defer conn.Close()
+	return conn.HandshakeContext(ctx)
+}
+
+/*
+ * @ UDPProber sends the configured payload as a datagram. With an
+ * expected body the reply must match it; otherwise the backend is
+ * healthy unless the host answers with ICMP port unreachable before
+ * the timeout, which is all UDP can tell about a silent service
+ */
+type UDPProber struct{}
+
+func (UDPProber) Probe(ctx context.Context, backend *Backend, check *HealthCheck) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", probeAddress(backend, check))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(check.Send); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxHealthCheckBody)
+	n, err := conn.Read(buf)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !check.needsBody() {
+			return nil
+		}
+		return err
+	}
+	if check.needsBody() && !check.matchesBody(buf[:n]) {
+		return fmt.Errorf("response does not match")
+	}
+	return nil
+}
+
+/*
+ * @ GRPCProber implements the grpc.health.v1 Health/Check protocol
+ * the request and response messages are tiny, so they are encoded
+ * by hand instead of pulling in a protobuf dependency:
+ *   HealthCheckRequest  { string service = 1; }
+ *   HealthCheckResponse { ServingStatus status = 1; }  // SERVING = 1
+ * https backends are checked over TLS, others over h2c
+ */
+type GRPCProber struct{}
+
+const grpcServing = 1
+
+func (GRPCProber) Probe(ctx context.Context, backend *Backend, check *HealthCheck) error {
+	scheme := "http"
+	protocols := new(http.Protocols)
+	if backend.URL.Scheme == "https" {
+		scheme = "https"
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	transport := &http.Transport{
+		Protocols:       protocols,
+		DialContext:     backend.dialContext,
+		TLSClientConfig: probeTLSConfig(backend, check),
+	}
+	defer transport.CloseIdleConnections()
+
+	url := scheme + "://" + probeAddress(backend, check) + "/grpc.health.v1.Health/Check"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(grpcHealthRequest(check.GRPCService)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for name, value := range check.Headers {
+		req.Header.Set(name, value)
+	}
+	if check.Host != "" {
+		req.Host = check.Host
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		return err
+	}
+
+	// Errors may come as trailers or, for trailers-only responses, as headers
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	serving, err := grpcHealthStatus(body)
+	if err != nil {
+		return err
+	}
+	if serving != grpcServing {
+		return fmt.Errorf("grpc serving status %d", serving)
+	}
+	return nil
+}
+
+// grpcHealthRequest encodes a length-prefixed HealthCheckRequest message
+func grpcHealthRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = append(msg, 0x0a) // field 1, wire type 2 (length-delimited)
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcHealthStatus decodes the status field of a length-prefixed HealthCheckResponse
+func grpcHealthStatus(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, fmt.Errorf("short grpc response")
+	}
+	if frame[0] != 0 {
+		return 0, fmt.Errorf("compressed grpc response not supported")
+	}
+	size := binary.BigEndian.Uint32(frame[1:5])
+	if uint32(len(frame)-5) < size {
+		return 0, fmt.Errorf("truncated grpc response")
+	}
+	msg := frame[5 : 5+size]
+
+	// Walk the fields, skipping anything but field 1
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed grpc response")
+		}
+		msg = msg[n:]
+
+		switch tag & 7 {
+		case 0: // varint
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, fmt.Errorf("malformed grpc response")
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = value
+			}
+		case 2: // length-delimited
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return 0, fmt.Errorf("malformed grpc response")
+			}
+			msg = msg[n+int(length):]
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return 0, fmt.Errorf("malformed grpc response")
+			}
+			msg = msg[8:]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return 0, fmt.Errorf("malformed grpc response")
+			}
+			msg = msg[4:]
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d in grpc response", tag&7)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// grpcFrame wraps a message in the gRPC length prefix
+func grpcFrame(compressed byte, msg []byte) []byte {
+	frame := []byte{compressed}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestGRPCHealthRequest(t *testing.T) {
+	long := strings.Repeat("s", 200)
+
+	tests := []struct {
+		name    string
+		service string
+		want    []byte
+	}{
+		{
+			name: "empty service",
+			want: []byte{0, 0, 0, 0, 0},
+		},
+		{
+			name:    "named service",
+			service: "grpc.health.v1.Health",
+			want:    grpcFrame(0, append([]byte{0x0a, 21}, "grpc.health.v1.Health"...)),
+		},
+		{
+			name:    "multi-byte length",
+			service: long,
+			want:    grpcFrame(0, append([]byte{0x0a, 0xc8, 0x01}, long...)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := grpcHealthRequest(tt.service); !bytes.Equal(got, tt.want) {
+				t.Errorf("grpcHealthRequest(%q) = %x, want %x", tt.service, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCHealthStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  []byte
+		status uint64
+		err    bool
+	}{
+		{
+			name:   "serving",
+			frame:  grpcFrame(0, []byte{0x08, 0x01}),
+			status: 1,
+		},
+		{
+			name:   "not serving",
+			frame:  grpcFrame(0, []byte{0x08, 0x02}),
+			status: 2,
+		},
+		{
+			// proto3 omits default values, so an empty message is UNKNOWN
+			name:   "empty message",
+			frame:  grpcFrame(0, nil),
+			status: 0,
+		},
+		{
+			name: "unknown fields skipped",
+			frame: grpcFrame(0, []byte{
+				0x10, 0x96, 0x01, // field 2 varint 150
+				0x1a, 0x03, 'a', 'b', 'c', // field 3 bytes
+				0x08, 0x01, // status SERVING
+				0x21, 1, 2, 3, 4, 5, 6, 7, 8, // field 4 fixed64
+				0x2d, 1, 2, 3, 4, // field 5 fixed32
+			}),
+			status: 1,
+		},
+		{
+			name:   "last status wins",
+			frame:  grpcFrame(0, []byte{0x08, 0x02, 0x08, 0x01}),
+			status: 1,
+		},
+		{
+			name:   "trailing data after the message",
+			frame:  append(grpcFrame(0, []byte{0x08, 0x01}), 0xff, 0xff),
+			status: 1,
+		},
+		{
+			name:  "compressed flag",
+			frame: grpcFrame(1, []byte{0x08, 0x01}),
+			err:   true,
+		},
+		{
+			name:  "short prefix",
+			frame: []byte{0, 0, 0},
+			err:   true,
+		},
+		{
+			name:  "truncated message",
+			frame: grpcFrame(0, []byte{0x08, 0x01})[:6],
+			err:   true,
+		},
+		{
+			name:  "truncated varint",
+			frame: grpcFrame(0, []byte{0x08, 0x96}),
+			err:   true,
+		},
+		{
+			name:  "truncated tag",
+			frame: grpcFrame(0, []byte{0x88}),
+			err:   true,
+		},
+		{
+			name:  "truncated bytes field",
+			frame: grpcFrame(0, []byte{0x1a, 0x05, 'a', 'b'}),
+			err:   true,
+		},
+		{
+			name:  "truncated fixed64 field",
+			frame: grpcFrame(0, []byte{0x21, 1, 2, 3}),
+			err:   true,
+		},
+		{
+			name:  "truncated fixed32 field",
+			frame: grpcFrame(0, []byte{0x2d, 1, 2}),
+			err:   true,
+		},
+		{
+			name:  "group wire type",
+			frame: grpcFrame(0, []byte{0x0b}),
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := grpcHealthStatus(tt.frame)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got status %d", status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+// probe runs one health check of the given type against the URL
+func probe(t *testing.T, url string, config HealthCheckConfig) error {
+	t.Helper()
+	backend := testBackend(t, url, config)
+	check := backend.HealthCheck()
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+	return probers[check.Type].Probe(ctx, backend, check)
+}
+
+// closedPort returns a local address nothing listens on
+func closedPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestTCPProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	if err := probe(t, "tcp://"+ln.Addr().String(), HealthCheckConfig{Type: HealthCheckTCP}); err != nil {
+		t.Errorf("listening backend: %v", err)
+	}
+	if err := probe(t, "tcp://"+closedPort(t), HealthCheckConfig{Type: HealthCheckTCP}); err == nil {
+		t.Error("closed port reported healthy")
+	}
+	// The check port overrides the backend's
+	portNumber, _ := strconv.Atoi(port)
+	if err := probe(t, "tcp://"+closedPort(t), HealthCheckConfig{Type: HealthCheckTCP, Port: portNumber}); err != nil {
+		t.Errorf("check port: %v", err)
+	}
+}
+
+func TestTLSProber(t *testing.T) {
+	ca := newTestCA(t)
+	pair, _, _ := ca.issue(t, "db.internal", "db.internal")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	addr := "tcp://" + ln.Addr().String()
+
+	if err := probe(t, addr, HealthCheckConfig{Type: HealthCheckTLS, SkipVerify: true}); err != nil {
+		t.Errorf("handshake without verification: %v", err)
+	}
+	// The test CA is not trusted, so verification fails
+	if err := probe(t, addr, HealthCheckConfig{Type: HealthCheckTLS, ServerName: "db.internal"}); err == nil {
+		t.Error("certificate from an unknown CA accepted")
+	}
+
+	// The pool's upstream TLS supplies the trusted roots
+	backend := testBackend(t, addr, HealthCheckConfig{Type: HealthCheckTLS, ServerName: "db.internal"})
+	backend.tlsConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	backend.tlsConfig.RootCAs.AddCert(ca.cert)
+	if err := (TLSProber{}).Probe(context.Background(), backend, backend.HealthCheck()); err != nil {
+		t.Errorf("trusted certificate: %v", err)
+	}
+	backend.SetHealthCheck(&HealthCheck{Type: HealthCheckTLS, ServerName: "other.internal", Rise: 1, Fall: 1})
+	if err := (TLSProber{}).Probe(context.Background(), backend, backend.HealthCheck()); err == nil {
+		t.Error("certificate for another name accepted")
+	}
+
+	// A plain TCP service fails the handshake
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	go func() {
+		conn, err := plain.Accept()
+		if err == nil {
+			conn.Write([]byte("220 smtp ready\r\n"))
+			conn.Close()
+		}
+	}()
+	if err := probe(t, "tcp://"+plain.Addr().String(), HealthCheckConfig{Type: HealthCheckTLS, SkipVerify: true}); err == nil {
+		t.Error("plain TCP service passed a TLS check")
+	}
+}
+
+// grpcHealthServer answers grpc.health.v1.Health/Check with the status
+// of each service; unknown services get NOT_FOUND
+func grpcHealthServer(t *testing.T, statuses map[string]byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Method != http.MethodPost || r.URL.Path != "/grpc.health.v1.Health/Check" ||
+			r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("TE") != "trailers" {
+			t.Errorf("unexpected request %s %s %s content type %q", r.Proto, r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		service := ""
+		if len(body) > 7 {
+			service = string(body[7:])
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		status, ok := statuses[service]
+		if !ok {
+			// Trailers-only response
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown service")
+			return
+		}
+		w.Write(grpcFrame(0, []byte{0x08, status}))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+}
+
+func TestGRPCProber(t *testing.T) {
+	statuses := map[string]byte{"": 1, "orders": 1, "billing": 2}
+
+	h2c := httptest.NewUnstartedServer(grpcHealthServer(t, statuses))
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	tlsServer := httptest.NewUnstartedServer(grpcHealthServer(t, statuses))
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	for _, server := range []struct {
+		name string
+		url  string
+	}{{"h2c", h2c.URL}, {"tls", tlsServer.URL}} {
+		t.Run(server.name, func(t *testing.T) {
+			tests := []struct {
+				service string
+				healthy bool
+			}{
+				{service: "", healthy: true},
+				{service: "orders", healthy: true},
+				{service: "billing"},
+				{service: "missing"},
+			}
+			for _, tt := range tests {
+				err := probe(t, server.url, HealthCheckConfig{Type: HealthCheckGRPC, GRPCService: tt.service, SkipVerify: true})
+				if (err == nil) != tt.healthy {
+					t.Errorf("service %q: error = %v, want healthy %v", tt.service, err, tt.healthy)
+				}
+			}
+		})
+	}
+
+	// A plain HTTP/1.1 server is not a gRPC service
+	http1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer http1.Close()
+	if err := probe(t, http1.URL, HealthCheckConfig{Type: HealthCheckGRPC}); err == nil {
+		t.Error("HTTP/1.1 server passed a gRPC check")
+	}
+	if err := probe(t, "http://"+closedPort(t), HealthCheckConfig{Type: HealthCheckGRPC}); err == nil {
+		t.Error("closed port passed a gRPC check")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ACME http-01 challenges must stay reachable over plain HTTP
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// hstsPreloadMinAge is the shortest max-age accepted by the preload list
+const hstsPreloadMinAge = 31536000
+
+/*
+ * @ HTTPSPolicy moves clients of a frontend to HTTPS: plain HTTP
+ * requests are redirected to the HTTPS listener except on exempt
+ * paths, and HTTPS responses carry a Strict-Transport-Security header
+ */
+type HTTPSPolicy struct {
+	redirect bool
+	port     int
+	exempt   []string
+	hsts     string
+}
+
+// NewHTTPSPolicy validates the redirect and HSTS settings. It returns
+// nil when neither is enabled.
+func NewHTTPSPolicy(config HTTPSPolicyConfig, global *Config) (*HTTPSPolicy, error) {
+	if !config.RedirectHTTPS && config.HSTS.MaxAge <= 0 {
+		return nil, nil
+	}
+	if !global.EnableHTTPS {
+		return nil, fmt.Errorf("redirect_https and hsts require enable_https")
+	}
+
+	policy := &HTTPSPolicy{
+		redirect: config.RedirectHTTPS,
+		port:     config.RedirectPort,
+		exempt:   append([]string{acmeChallengePath}, config.RedirectExempt...),
+	}
+	if policy.port == 0 {
+		policy.port = global.HTTPSPort
+	}
+	for _, path := range config.RedirectExempt {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("redirect exempt path must start with /: %s", path)
+		}
+	}
+
+	hsts := config.HSTS
+	if hsts.MaxAge > 0 {
+		if hsts.Preload && (!hsts.IncludeSubdomains || hsts.MaxAge < hstsPreloadMinAge) {
+			return nil, fmt.Errorf("hsts preload requires include_subdomains and max_age_seconds of at least %d", hstsPreloadMinAge)
+		}
+		policy.hsts = "max-age=" + strconv.Itoa(hsts.MaxAge)
+		if hsts.IncludeSubdomains {
+			policy.hsts += "; includeSubDomains"
+		}
+		if hsts.Preload {
+			policy.hsts += "; preload"
+		}
+	}
+	return policy, nil
+}
+
+// exempted reports whether the path may be served over plain HTTP
+func (p *HTTPSPolicy) exempted(path string) bool {
+	for _, prefix := range p.exempt {
+		if pathHasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectURL returns the HTTPS location of a request, keeping its
+// path and query
+func (p *HTTPSPolicy) redirectURL(r *http.Request) string {
+	host := strings.Trim(requestHost(r), "[]")
+	if p.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(p.port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+// EnforceHTTPS applies the HTTPS policy of the request's frontend before
+// the request reaches the handler. It wraps proxied traffic only, so the
+// health endpoint, dashboard and API answer on both listeners. The scheme
+// is the one the client used, so requests relayed by a TLS-terminating
+// trusted proxy are not redirected again.
+func (lb *LoadBalancer) EnforceHTTPS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := lb.httpsPolicy(r)
+		if policy == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme := newForwardedInfo(r, lb.trusted, false).proto
+		if scheme != "https" {
+			if policy.redirect && !policy.exempted(r.URL.Path) {
+				// 308 keeps the method and body of non-GET requests
+				status := http.StatusPermanentRedirect
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					status = http.StatusMovedPermanently
+				}
+				http.Redirect(w, r, policy.redirectURL(r), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.hsts != "" {
+			w = &hstsWriter{ResponseWriter: w, value: policy.hsts}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsPolicy returns the policy of the frontend serving the request's
+// host, falling back to the top-level policy
+func (lb *LoadBalancer) httpsPolicy(r *http.Request) *HTTPSPolicy {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	if policy := lb.httpsHosts.match(requestHost(r)); policy != nil {
+		return policy
+	}
+	return lb.https
+}
+
+// hstsWriter sets the Strict-Transport-Security header just before the
+// response header is written, replacing any value sent by a backend
+type hstsWriter struct {
+	http.ResponseWriter
+	value string
+	wrote bool
+}
+
+func (w *hstsWriter) WriteHeader(code int) {
+	// Informational responses precede the final header
+	if !w.wrote && code >= 200 {
+		w.wrote = true
+		w.Header().Set("Strict-Transport-Security", w.value)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *hstsWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and connection upgrades
+func (w *hstsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnforceHTTPS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb, err := NewLoadBalancer(&Config{
+		EnableHTTPS: true,
+		HTTPSPort:   8443,
+		HTTPSPolicyConfig: HTTPSPolicyConfig{
+			RedirectHTTPS:  true,
+			RedirectExempt: []string{"/status"},
+			HSTS:           HSTSConfig{MaxAge: 600},
+		},
+		TrustedProxies: []string{"10.0.0.1"},
+		PoolConfig:     PoolConfig{Backends: []BackendConfig{{URL: backend.URL}}},
+		Frontends: []FrontendConfig{
+			{
+				Hosts: []string{"shop.example.com"},
+				Pool:  DefaultPool,
+				HTTPSPolicyConfig: HTTPSPolicyConfig{
+					RedirectHTTPS: true,
+					RedirectPort:  443,
+					HSTS:          HSTSConfig{MaxAge: 63072000, IncludeSubdomains: true},
+				},
+			},
+			{Hosts: []string{"legacy.example.com"}, Pool: DefaultPool, PlainHTTP: true},
+			{Hosts: []string{"other.example.com"}, Pool: DefaultPool},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := lb.EnforceHTTPS(http.HandlerFunc(lb.ServeHTTP))
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		tls      bool
+		header   map[string]string
+		remote   string
+		status   int
+		location string
+		hsts     string
+	}{
+		{name: "top-level redirect", url: "http://example.com/a?b=c", status: http.StatusMovedPermanently, location: "https://example.com:8443/a?b=c"},
+		{name: "post keeps method", method: "POST", url: "http://example.com/a", status: http.StatusPermanentRedirect, location: "https://example.com:8443/a"},
+		{name: "exempt path", url: "http://example.com/status/live", status: http.StatusOK},
+		{name: "acme challenge always exempt", url: "http://example.com/.well-known/acme-challenge/token", status: http.StatusOK},
+		{name: "top-level hsts", url: "https://example.com/", tls: true, status: http.StatusOK, hsts: "max-age=600"},
+		{name: "frontend redirect", url: "http://shop.example.com/cart", status: http.StatusMovedPermanently, location: "https://shop.example.com/cart"},
+		{name: "frontend hsts", url: "https://shop.example.com/", tls: true, status: http.StatusOK, hsts: "max-age=63072000; includeSubDomains"},
+		{name: "frontend exempt paths are its own", url: "http://shop.example.com/status", status: http.StatusMovedPermanently, location: "https://shop.example.com/status"},
+		{name: "plain http frontend not redirected", url: "http://legacy.example.com/", status: http.StatusOK},
+		{name: "plain http frontend has no hsts", url: "https://legacy.example.com/", tls: true, status: http.StatusOK},
+		{name: "frontend without policy inherits", url: "http://other.example.com/", status: http.StatusMovedPermanently, location: "https://other.example.com:8443/"},
+		{
+			name:   "tls terminated by trusted proxy",
+			url:    "http://example.com/",
+			remote: "10.0.0.1:5000",
+			header: map[string]string{"X-Forwarded-Proto": "https"},
+			status: http.StatusOK,
+			hsts:   "max-age=600",
+		},
+		{
+			name:     "forwarded proto from untrusted peer ignored",
+			url:      "http://example.com/",
+			header:   map[string]string{"X-Forwarded-Proto": "https"},
+			status:   http.StatusMovedPermanently,
+			location: "https://example.com:8443/",
+		},
+		{name: "ipv6 host", url: "http://[2001:db8::1]/", status: http.StatusMovedPermanently, location: "https://[2001:db8::1]:8443/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, tt.url, nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.remote != "" {
+				r.RemoteAddr = tt.remote
+			}
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("location = %q, want %q", got, tt.location)
+			}
+			if got := w.Header().Get("Strict-Transport-Security"); got != tt.hsts {
+				t.Errorf("hsts = %q, want %q", got, tt.hsts)
+			}
+		})
+	}
+}
+
+func TestPlainHTTPConflictsWithPolicy(t *testing.T) {
+	_, err := NewLoadBalancer(&Config{
+		EnableHTTPS: true,
+		PoolConfig:  PoolConfig{Backends: []BackendConfig{{URL: "http://10.0.0.1:8080"}}},
+		Frontends: []FrontendConfig{{
+			Hosts:             []string{"legacy.example.com"},
+			Pool:              DefaultPool,
+			PlainHTTP:         true,
+			HTTPSPolicyConfig: HTTPSPolicyConfig{RedirectHTTPS: true},
+		}},
+	})
+	if err == nil {
+		t.Error("plain_http together with redirect_https was accepted")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ticketKeysKept is how many session ticket keys are accepted at once:
+// the current key and the ones it replaced
+const ticketKeysKept = 3
+
+// tlsVersions maps "listener_tls" version names to protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves maps "listener_tls.curves" names to key exchange groups
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// HTTP/2 requires one of these suites when TLS 1.2 is allowed (RFC 7540, 9.2.2)
+var http2CipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+/*
+ * @ ListenerTLS holds the validated TLS settings of the HTTPS listener:
+ * protocol versions, cipher suites, key exchange groups, ALPN
+ * protocols, session ticket key rotation and client hello logging
+ */
+type ListenerTLS struct {
+	config    *tls.Config
+	protocols *http.Protocols
+	rotation  time.Duration
+	logHello  bool
+}
+
+// NewListenerTLS validates the listener TLS settings
+func NewListenerTLS(config ListenerTLSConfig) (*ListenerTLS, error) {
+	l := &ListenerTLS{
+		config:    &tls.Config{MinVersion: tls.VersionTLS12},
+		protocols: new(http.Protocols),
+		rotation:  time.Duration(config.SessionTicketRotation) * time.Second,
+		logHello:  config.LogClientHello,
+	}
+
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("listener_tls: unknown min_version %q (use 1.0, 1.1, 1.2 or 1.3)", config.MinVersion)
+		}
+		l.config.MinVersion = version
+	}
+	if config.MaxVersion != "" {
+		version, ok := tlsVersions[config.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("listener_tls: unknown max_version %q (use 1.0, 1.1, 1.2 or 1.3)", config.MaxVersion)
+		}
+		if version < l.config.MinVersion {
+			return nil, fmt.Errorf("listener_tls: max_version %s is below min_version", config.MaxVersion)
+		}
+		l.config.MaxVersion = version
+	}
+
+	// TLS 1.3 suites are not configurable, so the list only matters up to 1.2
+	if len(config.CipherSuites) > 0 {
+		if l.config.MinVersion == tls.VersionTLS13 {
+			return nil, fmt.Errorf("listener_tls: cipher_suites only apply to TLS 1.2 and below, but min_version is 1.3")
+		}
+		for _, name := range config.CipherSuites {
+			id, err := cipherSuiteID(name)
+			if err != nil {
+				return nil, err
+			}
+			l.config.CipherSuites = append(l.config.CipherSuites, id)
+		}
+	}
+
+	for _, name := range config.Curves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("listener_tls: unknown curve %q", name)
+		}
+		l.config.CurvePreferences = append(l.config.CurvePreferences, curve)
+	}
+
+	alpn := config.ALPN
+	if len(alpn) == 0 {
+		alpn = []string{"h2", "http/1.1"}
+	}
+	for _, proto := range alpn {
+		switch proto {
+		case "h2":
+			l.protocols.SetHTTP2(true)
+		case "http/1.1":
+			l.protocols.SetHTTP1(true)
+		default:
+			return nil, fmt.Errorf("listener_tls: unsupported alpn protocol %q (use h2 or http/1.1)", proto)
+		}
+	}
+	// Clients without ALPN always speak HTTP/1.1
+	l.protocols.SetHTTP1(true)
+	l.config.NextProtos = alpn
+
+	if l.protocols.HTTP2() && l.config.CipherSuites != nil && l.config.MinVersion < tls.VersionTLS13 &&
+		!slices.ContainsFunc(l.config.CipherSuites, func(id uint16) bool { return slices.Contains(http2CipherSuites, id) }) {
+		return nil, fmt.Errorf("listener_tls: h2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 in cipher_suites")
+	}
+
+	if config.SessionTicketRotation < 0 {
+		return nil, fmt.Errorf("listener_tls: invalid session_ticket_rotation_seconds %d", config.SessionTicketRotation)
+	}
+	if config.SessionTicketsDisabled {
+		if l.rotation > 0 {
+			return nil, fmt.Errorf("listener_tls: session_ticket_rotation_seconds is set but session tickets are disabled")
+		}
+		l.config.SessionTicketsDisabled = true
+	}
+	return l, nil
+}
+
+// cipherSuiteID resolves a cipher suite by its IANA name. Suites Go
+// considers insecure are rejected.
+func cipherSuiteID(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+				return 0, fmt.Errorf("listener_tls: %s is a TLS 1.3 suite, which is always enabled", name)
+			}
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("listener_tls: cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("listener_tls: unknown cipher suite %q", name)
+}
+
+// TLSConfig returns a copy of the listener configuration to add
+// certificates and hooks to
+func (l *ListenerTLS) TLSConfig() *tls.Config {
+	return l.config.Clone()
+}
+
+// Protocols returns the HTTP versions offered through ALPN
+func (l *ListenerTLS) Protocols() *http.Protocols {
+	return l.protocols
+}
+
+// LogClientHellos wraps the configuration's GetConfigForClient hook to
+// log every ClientHello, if enabled
+func (l *ListenerTLS) LogClientHellos(config *tls.Config) {
+	if !l.logHello {
+		return
+	}
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		log.Printf("TLS ClientHello from %s: server_name=%q versions=[%s] cipher_suites=[%s] curves=[%s] alpn=[%s]",
+			hello.Conn.RemoteAddr(), hello.ServerName, tlsVersionNames(hello.SupportedVersions),
+			cipherSuiteNames(hello.CipherSuites), curveNames(hello.SupportedCurves), strings.Join(hello.SupportedProtos, " "))
+		if next == nil {
+			return nil, nil
+		}
+		return next(hello)
+	}
+}
+
+// RotateTicketKeys replaces the session ticket key every rotation
+// interval, keeping the previous keys so recent tickets still resume.
+// Without an interval Go's built-in daily rotation is left in place.
+func (l *ListenerTLS) RotateTicketKeys(ctx context.Context, config *tls.Config) {
+	if l.rotation <= 0 || config.SessionTicketsDisabled {
+		return
+	}
+
+	var keys [][32]byte
+	rotate := func() {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			log.Printf("Session ticket key rotation failed: %v", err)
+			return
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > ticketKeysKept {
+			keys = keys[:ticketKeysKept]
+		}
+		config.SetSessionTicketKeys(keys)
+	}
+	rotate()
+
+	ticker := time.NewTicker(l.rotation)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rotate()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tlsVersionNames formats protocol versions for logging
+func tlsVersionNames(versions []uint16) string {
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = tls.VersionName(v)
+	}
+	return strings.Join(names, " ")
+}
+
+// cipherSuiteNames formats cipher suites for logging
+func cipherSuiteNames(suites []uint16) string {
+	names := make([]string, len(suites))
+	for i, id := range suites {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	return strings.Join(names, " ")
+}
+
+// curveNames formats key exchange groups for logging, using the names
+// accepted by "listener_tls.curves" where there is one
+func curveNames(curves []tls.CurveID) string {
+	names := make([]string, len(curves))
+	for i, curve := range curves {
+		names[i] = curve.String()
+		for name, id := range tlsCurves {
+			if id == curve {
+				names[i] = name
+			}
+		}
+	}
+	return strings.Join(names, " ")
+}
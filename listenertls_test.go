@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewListenerTLSRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ListenerTLSConfig
+		err    string
+	}{
+		{name: "unknown min version", config: ListenerTLSConfig{MinVersion: "1.4"}, err: "unknown min_version"},
+		{name: "unknown max version", config: ListenerTLSConfig{MaxVersion: "TLS1.3"}, err: "unknown max_version"},
+		{name: "max below min", config: ListenerTLSConfig{MinVersion: "1.3", MaxVersion: "1.2"}, err: "below min_version"},
+		{name: "max below default min", config: ListenerTLSConfig{MaxVersion: "1.1"}, err: "below min_version"},
+		{
+			name:   "suites with tls 1.3 only",
+			config: ListenerTLSConfig{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+			err:    "only apply to TLS 1.2",
+		},
+		{name: "tls 1.3 suite", config: ListenerTLSConfig{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, err: "TLS 1.3 suite"},
+		{name: "insecure suite", config: ListenerTLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, err: "insecure"},
+		{name: "unknown suite", config: ListenerTLSConfig{CipherSuites: []string{"TLS_FANCY"}}, err: "unknown cipher suite"},
+		{
+			name:   "h2 without its required suite",
+			config: ListenerTLSConfig{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}},
+			err:    "h2 requires",
+		},
+		{name: "unknown curve", config: ListenerTLSConfig{Curves: []string{"P-224"}}, err: "unknown curve"},
+		{name: "unknown alpn", config: ListenerTLSConfig{ALPN: []string{"h3"}}, err: "unsupported alpn"},
+		{name: "negative rotation", config: ListenerTLSConfig{SessionTicketRotation: -1}, err: "invalid session_ticket_rotation"},
+		{
+			name:   "rotation with tickets disabled",
+			config: ListenerTLSConfig{SessionTicketsDisabled: true, SessionTicketRotation: 3600},
+			err:    "session tickets are disabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewListenerTLS(tt.config)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewListenerTLS(t *testing.T) {
+	l, err := NewListenerTLS(ListenerTLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := l.TLSConfig()
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != 0 || config.CipherSuites != nil {
+		t.Errorf("defaults: min %x max %x suites %v", config.MinVersion, config.MaxVersion, config.CipherSuites)
+	}
+	if !slices.Equal(config.NextProtos, []string{"h2", "http/1.1"}) || !l.Protocols().HTTP2() || !l.Protocols().HTTP1() {
+		t.Errorf("default alpn = %v", config.NextProtos)
+	}
+
+	l, err = NewListenerTLS(ListenerTLSConfig{
+		MinVersion:             "1.2",
+		MaxVersion:             "1.3",
+		CipherSuites:           []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Curves:                 []string{"X25519", "P-256"},
+		ALPN:                   []string{"h2"},
+		SessionTicketsDisabled: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = l.TLSConfig()
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("versions = %x-%x", config.MinVersion, config.MaxVersion)
+	}
+	if !slices.Equal(config.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}) {
+		t.Errorf("suites = %v", config.CipherSuites)
+	}
+	if !slices.Equal(config.CurvePreferences, []tls.CurveID{tls.X25519, tls.CurveP256}) {
+		t.Errorf("curves = %v", config.CurvePreferences)
+	}
+	// Clients without ALPN are still served HTTP/1.1
+	if !slices.Equal(config.NextProtos, []string{"h2"}) || !l.Protocols().HTTP1() {
+		t.Errorf("alpn = %v, http/1.1 %v", config.NextProtos, l.Protocols().HTTP1())
+	}
+	if !config.SessionTicketsDisabled {
+		t.Error("session tickets not disabled")
+	}
+
+	// The h2 suite requirement does not apply when only TLS 1.3 is offered
+	// or HTTP/2 is not
+	for _, config := range []ListenerTLSConfig{
+		{ALPN: []string{"http/1.1"}, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}},
+		{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+	} {
+		if _, err := NewListenerTLS(config); err != nil {
+			t.Errorf("%+v: %v", config, err)
+		}
+	}
+
+	// Each call returns an independent copy
+	l.TLSConfig().MinVersion = tls.VersionTLS10
+	if l.TLSConfig().MinVersion != tls.VersionTLS12 {
+		t.Error("TLSConfig returned the shared configuration")
+	}
+}
+
+// The settings take effect in real handshakes
+func TestListenerTLSHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	pair, _, _ := ca.issue(t, "shop.example.com", "shop.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	l, err := NewListenerTLS(ListenerTLSConfig{
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"P-256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := l.TLSConfig()
+	server.Certificates = []tls.Certificate{pair}
+
+	handshake := func(client *tls.Config) (tls.ConnectionState, error) {
+		client.ServerName = "shop.example.com"
+		client.RootCAs = roots
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		go tls.Server(s, server).Handshake()
+		conn := tls.Client(c, client)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		err := conn.Handshake()
+		return conn.ConnectionState(), err
+	}
+
+	state, err := handshake(&tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || state.NegotiatedProtocol != "h2" {
+		t.Errorf("negotiated %s %s %q", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+	}
+
+	if _, err := handshake(&tls.Config{MinVersion: tls.VersionTLS13}); err == nil {
+		t.Error("TLS 1.3 client accepted by a max_version 1.2 listener")
+	}
+	if _, err := handshake(&tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}}); err == nil {
+		t.Error("client without the configured suite accepted")
+	}
+	if _, err := handshake(&tls.Config{CurvePreferences: []tls.CurveID{tls.X25519}}); err == nil {
+		t.Error("client without the configured curve accepted")
+	}
+}
+
+func TestListenerTLSRotatesTicketKeys(t *testing.T) {
+	ca := newTestCA(t)
+	pair, _, _ := ca.issue(t, "shop.example.com", "shop.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	l, err := NewListenerTLS(ListenerTLSConfig{SessionTicketRotation: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := l.TLSConfig()
+	server.Certificates = []tls.Certificate{pair}
+	// TLS 1.2 sends the ticket inside the handshake
+	client := &tls.Config{ServerName: "shop.example.com", RootCAs: roots, MaxVersion: tls.VersionTLS12, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	resumed := func() bool {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		go tls.Server(s, server).Handshake()
+		conn := tls.Client(c, client)
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return conn.ConnectionState().DidResume
+	}
+
+	// Tickets issued before rotation starts were sealed with Go's own keys
+	resumed()
+	if !resumed() {
+		t.Fatal("session did not resume")
+	}
+	l.rotation = 40 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.RotateTicketKeys(ctx, server)
+	time.Sleep(10 * time.Millisecond)
+	if resumed() {
+		t.Error("ticket sealed before rotation started still resumed")
+	}
+
+	// A ticket outlives one rotation, but not ticketKeysKept of them
+	time.Sleep(l.rotation + l.rotation/2)
+	if !resumed() {
+		t.Error("ticket did not resume after one rotation")
+	}
+	time.Sleep(time.Duration(ticketKeysKept+2) * l.rotation)
+	if resumed() {
+		t.Error("ticket resumed after its key was rotated out")
+	}
+
+	// Rotation does nothing once tickets are disabled
+	disabled, err := NewListenerTLS(ListenerTLSConfig{SessionTicketsDisabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := make(chan struct{})
+	go func() {
+		disabled.RotateTicketKeys(context.Background(), disabled.TLSConfig())
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Error("rotation started although session tickets are disabled")
+	}
+}
@@ -5,202 +5,271 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
-	"sync/atomic"
-	"time"
 )
 
-// LoadBalancer manages the backend servers and routing
+// LoadBalancer routes requests to backend pools by route and host
 type LoadBalancer struct {
-	backends      []*Backend
-	current       uint64
-	healthChecker *HealthChecker
-	config        *Config
-	mu            sync.RWMutex
+	pools      map[string]*Pool
+	routes     []*Route
+	hosts      hostTable[*Pool]
+	https      *HTTPSPolicy
+	httpsHosts hostTable[*HTTPSPolicy]
+	tcp        []*TCPProxy
+	udp        []*UDPProxy
+	trusted    *TrustedProxies
+	clients    *ClientAuth
+	config     *Config
+	mu         sync.RWMutex
 }
 
 // NewLoadBalancer creates a new load balancer instance
 func NewLoadBalancer(config *Config) (*LoadBalancer, error) {
-	backends := make([]*Backend, 0, len(config.Backends))
+	lb := &LoadBalancer{
+		pools:  make(map[string]*Pool),
+		config: config,
+	}
 
-	for _, bc := range config.Backends {
-		backend, err := NewBackend(bc.URL)
+	// Top-level backends form the default pool
+	if len(config.Backends) > 0 {
+		if _, exists := config.Pools[DefaultPool]; exists {
+			return nil, fmt.Errorf("pool %q is defined twice: top-level backends and pools", DefaultPool)
+		}
+		pool, err := NewPool(DefaultPool, config.PoolConfig)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create backend %s: %w", bc.URL, err)
+			return nil, err
 		}
-		backends = append(backends, backend)
-		log.Printf("Added backend: %s", bc.URL)
+		lb.pools[DefaultPool] = pool
 	}
 
-	if len(backends) == 0 {
-		return nil, fmt.Errorf("no backends configured")
+	for name, pc := range config.Pools {
+		pool, err := NewPool(name, pc)
+		if err != nil {
+			return nil, err
+		}
+		lb.pools[name] = pool
 	}
 
-	healthChecker := NewHealthChecker(backends, config.HealthCheckPath, config.HealthCheckInterval)
-
-	return &LoadBalancer{
-		backends:      backends,
-		healthChecker: healthChecker,
-		config:        config,
-	}, nil
-}
-
-// Start starts the load balancer and health checker
-func (lb *LoadBalancer) Start(ctx context.Context) {
-	go lb.healthChecker.Start(ctx)
-}
-
-// GetNextBackend returns the next available backend using smart round-robin
-// with smallest time-quanta-based scheduling
-func (lb *LoadBalancer) GetNextBackend() *Backend {
-	lb.mu.RLock()
-	defer lb.mu.RUnlock()
-
-	if len(lb.backends) == 0 {
-		return nil
+	if len(lb.pools) == 0 {
+		return nil, fmt.Errorf("no backends configured")
 	}
 
-	// Find backends with the smallest score
-	// Include backends within 20% of the best score for fair distribution
-	var bestBackends []*Backend
-	var bestScore float64 = -1
+	https, err := NewHTTPSPolicy(config.HTTPSPolicyConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	lb.https = https
 
-	for _, backend := range lb.backends {
-		if !backend.IsAlive() {
-			continue
+	for _, fc := range config.Frontends {
+		pool, ok := lb.pools[fc.Pool]
+		if !ok {
+			return nil, fmt.Errorf("frontend references unknown pool: %s", fc.Pool)
+		}
+		policy, err := NewHTTPSPolicy(fc.HTTPSPolicyConfig, config)
+		if err != nil {
+			return nil, fmt.Errorf("frontend %s: %w", strings.Join(fc.Hosts, ","), err)
 		}
+		if fc.PlainHTTP {
+			if policy != nil {
+				return nil, fmt.Errorf("frontend %s: plain_http conflicts with redirect_https and hsts", strings.Join(fc.Hosts, ","))
+			}
+			// An empty policy keeps the top-level one from applying
+			policy = &HTTPSPolicy{}
+		}
+		for _, host := range fc.Hosts {
+			if err := lb.hosts.add(host, pool); err != nil {
+				return nil, err
+			}
+			if policy != nil {
+				if err := lb.httpsHosts.add(host, policy); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
 
-		// Calculate score: lower is better
-		// Score = (time_quanta * (1 + connections)) + avg_latency
-		timeQuanta := float64(backend.GetTimeQuanta().Nanoseconds())
-		connections := float64(backend.GetActiveConnections())
-		avgLatency := float64(backend.GetMetrics().AvgLatency.Nanoseconds())
+	trusted, err := NewTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	lb.trusted = trusted
 
-		score := (timeQuanta * (1 + connections)) + avgLatency
+	lb.clients, err = NewClientAuth(config.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	if lb.clients != nil && !config.EnableHTTPS {
+		return nil, fmt.Errorf("client_auth requires enable_https")
+	}
 
-		if bestScore == -1 || score < bestScore {
-			bestScore = score
+	for _, rc := range config.Routes {
+		route, err := NewRoute(rc, lb.pools)
+		if err != nil {
+			return nil, err
 		}
+		lb.routes = append(lb.routes, route)
 	}
 
-	// Collect all backends within 20% of the best score
-	threshold := bestScore * 1.2
-	for _, backend := range lb.backends {
-		if !backend.IsAlive() {
-			continue
+	for _, tc := range config.TCPListeners {
+		proxy, err := NewTCPProxy(tc, lb.pools)
+		if err != nil {
+			return nil, err
 		}
+		lb.tcp = append(lb.tcp, proxy)
+	}
 
-		timeQuanta := float64(backend.GetTimeQuanta().Nanoseconds())
-		connections := float64(backend.GetActiveConnections())
-		avgLatency := float64(backend.GetMetrics().AvgLatency.Nanoseconds())
-		score := (timeQuanta * (1 + connections)) + avgLatency
-
-		if score <= threshold {
-			bestBackends = append(bestBackends, backend)
+	for _, uc := range config.UDPListeners {
+		pool, ok := lb.pools[uc.Pool]
+		if !ok {
+			return nil, fmt.Errorf("udp listener %s references unknown pool: %s", uc.Name, uc.Pool)
 		}
+		proxy, err := NewUDPProxy(uc, pool)
+		if err != nil {
+			return nil, err
+		}
+		lb.udp = append(lb.udp, proxy)
 	}
 
-	// If we have backends with the same best score, use round-robin among them
-	if len(bestBackends) > 0 {
-		idx := atomic.AddUint64(&lb.current, 1) % uint64(len(bestBackends))
-		return bestBackends[idx]
+	return lb, nil
+}
+
+// Start starts the health checkers of all pools
+func (lb *LoadBalancer) Start(ctx context.Context) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	for _, pool := range lb.pools {
+		pool.Start(ctx)
 	}
+}
+
+// Route returns the pool that should serve the request, the matching
+// route if any, and the request to send to the pool. Routes are
+// evaluated in order before host frontends; exact host names win over
+// wildcards, and unmatched requests fall back to the default pool.
+func (lb *LoadBalancer) Route(r *http.Request) (*Pool, *Route, *http.Request) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
 
-	// Fallback to simple round-robin if all backends are down
-	for i := 0; i < len(lb.backends); i++ {
-		idx := atomic.AddUint64(&lb.current, 1) % uint64(len(lb.backends))
-		backend := lb.backends[idx]
-		if backend.IsAlive() {
-			return backend
+	for _, route := range lb.routes {
+		if route.Matches(r) {
+			return route.pool, route, route.Rewrite(r)
 		}
 	}
 
-	// Return first backend as last resort
-	if len(lb.backends) > 0 {
-		return lb.backends[0]
+	if pool := lb.hosts.match(requestHost(r)); pool != nil {
+		return pool, nil, r
 	}
-
-	return nil
+	return lb.pools[DefaultPool], nil, r
 }
 
 // ServeHTTP handles incoming requests
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	backend := lb.GetNextBackend()
-
-	if backend == nil || !backend.IsAlive() {
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-		log.Printf("No healthy backends available")
+	r, info := withRequestInfo(r)
+	info.forwarded = newForwardedInfo(r, lb.trusted, lb.config.ForwardedHeader)
+	lb.clients.setIdentity(r)
+	if lb.clients.rejects(r) {
+		http.Error(w, "Client certificate required", http.StatusForbidden)
 		return
 	}
-
-	backend.IncrementConnections()
-	defer backend.DecrementConnections()
-
-	start := time.Now()
-	backend.ReverseProxy.ServeHTTP(w, r)
-	latency := time.Since(start)
-
-	backend.AddRequest(latency)
-	log.Printf("Proxied request to %s (latency: %v)", backend.URL.String(), latency)
+	pool, route, r := lb.Route(r)
+	if pool == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		log.Printf("No pool configured for %s%s", r.Host, r.URL.Path)
+		return
+	}
+	info.route = route
+	pool.ServeHTTP(w, r)
 }
 
-// GetMetrics returns metrics for all backends
-func (lb *LoadBalancer) GetMetrics() []BackendMetrics {
+// GetPool returns the pool with the given name
+func (lb *LoadBalancer) GetPool(name string) (*Pool, error) {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
-	metrics := make([]BackendMetrics, 0, len(lb.backends))
-	for _, backend := range lb.backends {
-		metrics = append(metrics, backend.GetMetrics())
+	pool, ok := lb.pools[name]
+	if !ok {
+		return nil, fmt.Errorf("pool not found: %s", name)
 	}
-	return metrics
+	return pool, nil
 }
 
-// AddBackend adds a new backend to the load balancer
-func (lb *LoadBalancer) AddBackend(urlStr string) error {
-	backend, err := NewBackend(urlStr)
-	if err != nil {
-		return fmt.Errorf("failed to create backend %s: %w", urlStr, err)
-	}
+// GetPools returns all pools sorted by name
+func (lb *LoadBalancer) GetPools() []*Pool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
 
-	lb.mu.Lock()
-	lb.backends = append(lb.backends, backend)
-	lb.mu.Unlock()
+	pools := make([]*Pool, 0, len(lb.pools))
+	for _, pool := range lb.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].name < pools[j].name })
+	return pools
+}
 
-	// Add to health checker
-	lb.healthChecker.AddBackend(backend)
+// ClientAuth returns the client certificate policy of the HTTPS
+// listener, nil when client authentication is disabled
+func (lb *LoadBalancer) ClientAuth() *ClientAuth {
+	return lb.clients
+}
 
-	log.Printf("Added backend: %s", urlStr)
-	return nil
+// TCPProxies returns the layer-4 listeners
+func (lb *LoadBalancer) TCPProxies() []*TCPProxy {
+	return lb.tcp
 }
 
-// RemoveBackend removes a backend from the load balancer
-func (lb *LoadBalancer) RemoveBackend(urlStr string) error {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+// UDPProxies returns the UDP listeners
+func (lb *LoadBalancer) UDPProxies() []*UDPProxy {
+	return lb.udp
+}
 
-	for i, backend := range lb.backends {
-		if backend.URL.String() == urlStr {
-			// Remove from backends slice
-			lb.backends = append(lb.backends[:i], lb.backends[i+1:]...)
+// GetConnections returns the active connections and sessions of all
+// layer-4 listeners
+func (lb *LoadBalancer) GetConnections() []ConnectionMetrics {
+	connections := []ConnectionMetrics{}
+	for _, proxy := range lb.tcp {
+		connections = append(connections, proxy.GetConnections()...)
+	}
+	for _, proxy := range lb.udp {
+		connections = append(connections, proxy.GetConnections()...)
+	}
+	return connections
+}
 
-			// Remove from health checker
-			lb.healthChecker.RemoveBackend(backend)
+// GetMetrics returns metrics for all backends in all pools
+func (lb *LoadBalancer) GetMetrics() []BackendMetrics {
+	var metrics []BackendMetrics
+	for _, pool := range lb.GetPools() {
+		metrics = append(metrics, pool.GetMetrics()...)
+	}
+	return metrics
+}
 
-			log.Printf("Removed backend: %s", urlStr)
-			return nil
-		}
+// AddBackend adds a new backend to the named pool
+func (lb *LoadBalancer) AddBackend(poolName string, bc BackendConfig) error {
+	pool, err := lb.GetPool(poolName)
+	if err != nil {
+		return err
 	}
+	return pool.AddBackend(bc)
+}
 
-	return fmt.Errorf("backend not found: %s", urlStr)
+// RemoveBackend removes a backend from the named pool
+func (lb *LoadBalancer) RemoveBackend(poolName string, urlStr string) error {
+	pool, err := lb.GetPool(poolName)
+	if err != nil {
+		return err
+	}
+	return pool.RemoveBackend(urlStr)
 }
 
-// GetBackends returns a copy of the backends list
+// GetBackends returns the backends of all pools
 func (lb *LoadBalancer) GetBackends() []*Backend {
-	lb.mu.RLock()
-	defer lb.mu.RUnlock()
-
-	backends := make([]*Backend, len(lb.backends))
-	copy(backends, lb.backends)
+	var backends []*Backend
+	for _, pool := range lb.GetPools() {
+		backends = append(backends, pool.GetBackends()...)
+	}
 	return backends
 }
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -25,6 +26,7 @@ func main() {
 			 *  default to config.json
 	*/
 	configPath := flag.String("config", "config.json", "Path to configuration file")
+	watchInterval := flag.Duration("watch-interval", defaultConfigWatchInterval, "How often to check the configuration file for changes (0 disables)")
 	flag.Parse()
 
 	config, err := LoadConfig(*configPath)
@@ -32,7 +34,11 @@ func main() {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	log.Printf("FluxLB starting with %d backends on port %d", len(config.Backends), config.Port)
+	backendCount := len(config.Backends)
+	for _, pool := range config.Pools {
+		backendCount += len(pool.Backends)
+	}
+	log.Printf("FluxLB starting with %d backends on port %d", backendCount, config.Port)
 
 	/*
 		 * @ Initialize load balancer
@@ -44,6 +50,15 @@ func main() {
 		log.Fatalf("Failed to create load balancer: %v", err)
 	}
 
+	// Backend changes made through the API are replayed over the config
+	state, err := NewStateStore(config.StateFile)
+	if err != nil {
+		log.Fatalf("Failed to load state file: %v", err)
+	}
+	if err := state.Apply(lb); err != nil {
+		log.Fatalf("Failed to save state file: %v", err)
+	}
+
 	dashboard, err := NewDashboard(lb)
 	if err != nil {
 		log.Fatalf("Failed to create dashboard: %v", err)
@@ -53,7 +68,7 @@ func main() {
 	authManager := NewAuthManager(&config.Auth)
 
 	// Initialize API handler
-	apiHandler := NewAPIHandler(lb, authManager)
+	apiHandler := NewAPIHandler(lb, authManager, state)
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -61,13 +76,19 @@ func main() {
 
 	lb.Start(ctx)
 
+	// Backends, health checks and auth settings are reloaded while running
+	reloader := NewConfigReloader(*configPath, config, lb, authManager, state)
+	if *watchInterval > 0 {
+		go reloader.Watch(ctx, *watchInterval)
+	}
+
 	/*
 		 * @ Start HTTP server
 			* with health check endpoint
 			* and dashboard endpoint
 			* for monitoring backends
 			* and load balancing
-			* using smart round-robin algorithm
+			* using the configured balancing algorithm
 	*/
 	mux := http.NewServeMux()
 
@@ -83,9 +104,11 @@ func main() {
 	mux.HandleFunc("/api/backends/add", authManager.AuthMiddleware(apiHandler.HandleAddBackend))
 	mux.HandleFunc("/api/backends/remove", authManager.AuthMiddleware(apiHandler.HandleRemoveBackend))
 	mux.HandleFunc("/api/backends", authManager.AuthMiddleware(apiHandler.HandleGetBackends))
+	mux.HandleFunc("/api/connections", authManager.AuthMiddleware(apiHandler.HandleGetConnections))
 
-	// Load balancer proxy (unprotected for actual traffic)
-	mux.HandleFunc("/", lb.ServeHTTP)
+	// Load balancer proxy (unprotected for actual traffic), routed to pools
+	// by the route table and host frontends
+	mux.Handle("/", lb.EnforceHTTPS(http.HandlerFunc(lb.ServeHTTP)))
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", config.Port),
@@ -95,6 +118,35 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// Certificates are chosen by SNI and reloaded when their files change
+	var certs *CertStore
+	var listenerTLS *ListenerTLS
+	if config.EnableHTTPS {
+		listenerTLS, err = NewListenerTLS(config.ListenerTLS)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+		certs, err = NewCertStore(config)
+		if err != nil {
+			log.Fatalf("Failed to load certificates: %v", err)
+		}
+		go certs.Watch(ctx)
+	}
+
+	// ACME certificates are written to the store's directory as they are issued
+	var acme *ACMEManager
+	if config.ACME.Enabled {
+		if !config.EnableHTTPS {
+			log.Fatalf("ACME requires enable_https")
+		}
+		acme, err = NewACMEManager(config.ACME, certs)
+		if err != nil {
+			log.Fatalf("Failed to set up ACME: %v", err)
+		}
+		mux.Handle(acmeChallengePath, acme.ChallengeHandler(http.HandlerFunc(lb.ServeHTTP)))
+		go acme.Run(ctx)
+	}
+
 	/*
 		 * @ Start server in a goroutine
 			* to allow graceful shutdown
@@ -105,20 +157,32 @@ func main() {
 			log.Printf("Dashboard available at https://localhost:%d/dashboard", config.HTTPSPort)
 
 			// Create TLS config
-			tlsConfig := &tls.Config{
-				MinVersion: tls.VersionTLS12,
+			tlsConfig := listenerTLS.TLSConfig()
+			tlsConfig.GetCertificate = certs.GetCertificate
+			lb.ClientAuth().Configure(tlsConfig)
+			if acme != nil {
+				tlsConfig.GetConfigForClient = acme.GetConfigForClient
 			}
+			listenerTLS.LogClientHellos(tlsConfig)
+			go listenerTLS.RotateTicketKeys(ctx, tlsConfig)
 
 			httpsServer := &http.Server{
 				Addr:         fmt.Sprintf(":%d", config.HTTPSPort),
 				Handler:      mux,
 				TLSConfig:    tlsConfig,
+				Protocols:    listenerTLS.Protocols(),
 				ReadTimeout:  30 * time.Second,
 				WriteTimeout: 30 * time.Second,
 				IdleTimeout:  60 * time.Second,
 			}
 
-			if err := httpsServer.ListenAndServeTLS(config.CertFile, config.KeyFile); err != nil && err != http.ErrServerClosed {
+			ln, err := listen(httpsServer.Addr, config)
+			if err != nil {
+				log.Printf("HTTPS Server Error: %v", err)
+				return
+			}
+			// Serving on a TLS listener keeps tlsConfig live, so rotated ticket keys take effect
+			if err := httpsServer.Serve(tls.NewListener(ln, tlsConfig)); err != nil && err != http.ErrServerClosed {
 				log.Printf("HTTPS Server Error: %v", err)
 			}
 		}
@@ -127,11 +191,65 @@ func main() {
 	go func() {
 		log.Printf("FluxLB HTTP listening on http://localhost:%d", config.Port)
 		log.Printf("Dashboard available at http://localhost:%d/dashboard", config.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		ln, err := listen(server.Addr, config)
+		if err != nil {
+			log.Fatalf("Server Error: %v", err)
+		}
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server Error: %v", err)
 		}
 	}()
 
+	// Layer-4 listeners stop accepting when ctx is cancelled
+	for _, proxy := range lb.TCPProxies() {
+		ln, err := listen(proxy.Addr(), config)
+		if err != nil {
+			log.Fatalf("TCP listener %s error: %v", proxy.Name(), err)
+		}
+		log.Printf("FluxLB TCP listener %s on %s", proxy.Name(), proxy.Addr())
+		go func(proxy *TCPProxy) {
+			if err := proxy.Serve(ctx, ln); err != nil {
+				log.Printf("TCP listener %s error: %v", proxy.Name(), err)
+			}
+		}(proxy)
+	}
+
+	for _, proxy := range lb.UDPProxies() {
+		addr, err := net.ResolveUDPAddr("udp", proxy.Addr())
+		if err != nil {
+			log.Fatalf("UDP listener %s error: %v", proxy.Name(), err)
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			log.Fatalf("UDP listener %s error: %v", proxy.Name(), err)
+		}
+		log.Printf("FluxLB UDP listener %s on %s", proxy.Name(), proxy.Addr())
+		go func(proxy *UDPProxy) {
+			if err := proxy.Serve(ctx, conn); err != nil {
+				log.Printf("UDP listener %s error: %v", proxy.Name(), err)
+			}
+		}(proxy)
+	}
+
+	// SIGHUP reloads the configuration and certificates immediately
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Printf("Reloading configuration")
+			if err := reloader.Reload(); err != nil {
+				log.Printf("Config reload failed, keeping running configuration: %v", err)
+			}
+			if certs == nil {
+				continue
+			}
+			log.Printf("Reloading certificates")
+			if err := certs.Reload(); err != nil {
+				log.Printf("Certificate reload failed, keeping previous certificates: %v", err)
+			}
+		}
+	}()
+
 	/*
 		 * @ Wait for interrupt signal
 			* to gracefully shutdown the server
@@ -150,3 +268,21 @@ func main() {
 
 	log.Println("FluxLB stopped")
 }
+
+// listen opens a TCP listener, accepting PROXY protocol headers if enabled
+func listen(addr string, config *Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !config.ProxyProtocol.Enabled {
+		return ln, nil
+	}
+
+	pln, err := NewProxyProtocolListener(ln, config.ProxyProtocol, config.TrustedProxies)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return pln, nil
+}
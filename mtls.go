@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Client certificate modes accepted by "client_auth.mode"
+const (
+	ClientAuthRequired = "required"
+	ClientAuthOptional = "optional"
+)
+
+const defaultIdentityHeader = "X-Client-Cert-Subject"
+
+// newUpstreamTLS builds the TLS client configuration used to dial a
+// pool's https backends. It returns nil when nothing is configured.
+func newUpstreamTLS(config UpstreamTLSConfig) (*tls.Config, error) {
+	if config == (UpstreamTLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.SkipVerify,
+	}
+	if config.CAFile != "" {
+		roots, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+/*
+ * @ ClientAuth verifies client certificates on the HTTPS listener and
+ * passes the verified identity to backends in a request header. The
+ * header is always replaced, so clients cannot supply their own
+ */
+type ClientAuth struct {
+	mode   tls.ClientAuthType
+	roots  *x509.CertPool
+	header string
+}
+
+// NewClientAuth creates the client certificate policy, or nil when
+// client authentication is not configured
+func NewClientAuth(config ClientAuthConfig) (*ClientAuth, error) {
+	if config.CAFile == "" && config.Mode == "" {
+		return nil, nil
+	}
+
+	ca := &ClientAuth{header: config.IdentityHeader}
+	if ca.header == "" {
+		ca.header = defaultIdentityHeader
+	}
+	switch config.Mode {
+	case "", ClientAuthRequired:
+		ca.mode = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		ca.mode = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client_auth mode: %s", config.Mode)
+	}
+
+	if config.CAFile == "" {
+		return nil, fmt.Errorf("client_auth requires ca_file")
+	}
+	roots, err := loadCertPool(config.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("client_auth: %w", err)
+	}
+	ca.roots = roots
+	return ca, nil
+}
+
+// Configure makes the listener request and verify client certificates
+func (ca *ClientAuth) Configure(config *tls.Config) {
+	if ca == nil {
+		return
+	}
+	config.ClientAuth = ca.mode
+	config.ClientCAs = ca.roots
+}
+
+// setIdentity replaces the identity header with the subject of the
+// verified client certificate, if any
+func (ca *ClientAuth) setIdentity(r *http.Request) {
+	if ca == nil {
+		return
+	}
+	r.Header.Del(ca.header)
+	if cert := verifiedClientCert(r); cert != nil {
+		r.Header.Set(ca.header, cert.Subject.String())
+	}
+}
+
+// rejects reports whether a request must be refused because client
+// certificates are required and it carries none, such as a request on
+// the plain HTTP listener
+func (ca *ClientAuth) rejects(r *http.Request) bool {
+	return ca != nil && ca.mode == tls.RequireAndVerifyClientCert && verifiedClientCert(r) == nil
+}
+
+// verifiedClientCert returns the client certificate the TLS handshake
+// verified, or nil
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// clientIdentities returns the names a client certificate vouches for:
+// its common name and its DNS, email and URI subject alternative names
+func clientIdentities(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
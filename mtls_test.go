@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAuthRequiredRejectsPlainHTTP(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := writeTestFile(t, t.TempDir(), "ca.pem", ca.pem)
+	client, _, _ := ca.issue(t, "alice")
+
+	var identity string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = r.Header.Get(defaultIdentityHeader)
+	}))
+	defer backend.Close()
+
+	withCert := func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{client.Leaf, ca.cert}}}
+	}
+	withoutCert := func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{}
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		prepare  func(*http.Request)
+		status   int
+		identity string
+	}{
+		{name: "required, plain http", mode: ClientAuthRequired, status: http.StatusForbidden},
+		{name: "required, tls with certificate", mode: ClientAuthRequired, prepare: withCert, status: http.StatusOK, identity: "CN=alice"},
+		{name: "required, tls without certificate", mode: ClientAuthRequired, prepare: withoutCert, status: http.StatusForbidden},
+		{name: "optional, plain http", mode: ClientAuthOptional, status: http.StatusOK},
+		{name: "optional, tls with certificate", mode: ClientAuthOptional, prepare: withCert, status: http.StatusOK, identity: "CN=alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(&Config{
+				EnableHTTPS: true,
+				ClientAuth:  ClientAuthConfig{CAFile: caFile, Mode: tt.mode},
+				PoolConfig:  PoolConfig{Backends: []BackendConfig{{URL: backend.URL}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			identity = "unset"
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.Header.Set(defaultIdentityHeader, "CN=mallory")
+			if tt.prepare != nil {
+				tt.prepare(r)
+			}
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if identity != "unset" {
+					t.Error("rejected request reached the backend")
+				}
+				return
+			}
+			if identity != tt.identity {
+				t.Errorf("identity header = %q, want %q", identity, tt.identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Outlier detection defaults
+const (
+	defaultConsecutiveErrors = 5
+	defaultBaseEjection      = 30 * time.Second
+	defaultMaxEjection       = 300 * time.Second
+	defaultMaxEjectionPct    = 50
+)
+
+/*
+ * @ OutlierDetector ejects backends based on live proxied traffic
+ * a backend that returns too many consecutive 5xx responses or
+ * connection errors is taken out of rotation for an exponentially
+ * growing period, independently of the active health checker.
+ * At most max_ejection_percent of the pool is ejected at once, so a
+ * fault shared by all backends cannot empty the pool
+ */
+type OutlierDetector struct {
+	consecutiveErrors  int
+	baseEjection       time.Duration
+	maxEjection        time.Duration
+	maxEjectionPercent int
+
+	// serializes ejections so concurrent ones cannot exceed the cap
+	mu sync.Mutex
+}
+
+// NewOutlierDetector creates an outlier detector, applying defaults for unset fields
+func NewOutlierDetector(config OutlierConfig) *OutlierDetector {
+	od := &OutlierDetector{
+		consecutiveErrors:  config.ConsecutiveErrors,
+		baseEjection:       time.Duration(config.BaseEjectionTime) * time.Second,
+		maxEjection:        time.Duration(config.MaxEjectionTime) * time.Second,
+		maxEjectionPercent: config.MaxEjectionPercent,
+	}
+	if od.consecutiveErrors <= 0 {
+		od.consecutiveErrors = defaultConsecutiveErrors
+	}
+	if od.baseEjection <= 0 {
+		od.baseEjection = defaultBaseEjection
+	}
+	if od.maxEjection <= 0 {
+		od.maxEjection = defaultMaxEjection
+	}
+	if od.maxEjection < od.baseEjection {
+		od.maxEjection = od.baseEjection
+	}
+	if od.maxEjectionPercent <= 0 || od.maxEjectionPercent > 100 {
+		od.maxEjectionPercent = defaultMaxEjectionPct
+	}
+	return od
+}
+
+// Observe records the outcome of a proxied request to b, one of the
+// pool's backends
+func (od *OutlierDetector) Observe(b *Backend, failed bool, backends []*Backend) {
+	b.mu.Lock()
+	if !failed {
+		b.consecutiveErrors = 0
+		b.mu.Unlock()
+		return
+	}
+	b.consecutiveErrors++
+	due := b.consecutiveErrors >= od.consecutiveErrors && !time.Now().Before(b.EjectedUntil)
+	b.mu.Unlock()
+
+	if due {
+		od.eject(b, backends)
+	}
+}
+
+// eject takes b out of rotation unless that would put the pool over
+// its ejection cap
+func (od *OutlierDetector) eject(b *Backend, backends []*Backend) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	ejected := 0
+	for _, backend := range backends {
+		if backend != b && backend.IsEjected() {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > od.maxEjectionPercent*len(backends) {
+		log.Printf("Backend %s not ejected: %d of %d backends already ejected", b.URL.String(), ejected, len(backends))
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(b.EjectedUntil) {
+		return
+	}
+
+	// Forget earlier ejections once the backend has behaved for a full max period
+	if !b.EjectedUntil.IsZero() && now.Sub(b.EjectedUntil) > od.maxEjection {
+		b.ejectionLevel = 0
+	}
+
+	// Double the ejection time on every repeat offence, up to the maximum
+	ejection := od.baseEjection << b.ejectionLevel
+	if ejection > od.maxEjection || ejection <= 0 {
+		ejection = od.maxEjection
+	} else {
+		b.ejectionLevel++
+	}
+
+	b.EjectedUntil = now.Add(ejection)
+	b.Ejections++
+	b.consecutiveErrors = 0
+	log.Printf("Backend %s ejected for %v after %d consecutive errors", b.URL.String(), ejection, od.consecutiveErrors)
+}
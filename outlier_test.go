@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestBackends(t *testing.T, n int) []*Backend {
+	t.Helper()
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backend, err := NewBackend(BackendConfig{URL: fmt.Sprintf("http://10.0.0.%d:8080", i+1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[i] = backend
+	}
+	return backends
+}
+
+// failBackend reports n consecutive failures of b
+func failBackend(od *OutlierDetector, b *Backend, backends []*Backend, n int) {
+	for range n {
+		od.Observe(b, true, backends)
+	}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	od := NewOutlierDetector(OutlierConfig{ConsecutiveErrors: 3, BaseEjectionTime: 10, MaxEjectionTime: 30})
+	backends := newTestBackends(t, 2)
+	b := backends[0]
+
+	failBackend(od, b, backends, 2)
+	od.Observe(b, false, backends)
+	failBackend(od, b, backends, 2)
+	if b.IsEjected() {
+		t.Fatal("ejected although a success reset the error count")
+	}
+	od.Observe(b, true, backends)
+	if !b.IsEjected() {
+		t.Fatal("not ejected after consecutive errors")
+	}
+	if until := time.Until(b.EjectedUntil); until < 9*time.Second || until > 10*time.Second {
+		t.Errorf("first ejection lasts %v, want 10s", until)
+	}
+
+	// Repeat offences double the ejection time up to the maximum
+	for _, want := range []time.Duration{20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		b.EjectedUntil = time.Now().Add(-time.Second)
+		failBackend(od, b, backends, 3)
+		if until := time.Until(b.EjectedUntil); until < want-time.Second || until > want {
+			t.Errorf("ejection lasts %v, want %v", until, want)
+		}
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	tests := []struct {
+		name     string
+		percent  int
+		backends int
+		failing  int
+		ejected  int
+	}{
+		{name: "default keeps the only backend", backends: 1, failing: 1, ejected: 0},
+		{name: "default ejects half", backends: 4, failing: 4, ejected: 2},
+		{name: "default ejects one of three", backends: 3, failing: 3, ejected: 1},
+		{name: "low percent", percent: 10, backends: 10, failing: 5, ejected: 1},
+		{name: "all may be ejected", percent: 100, backends: 2, failing: 2, ejected: 2},
+		{name: "invalid percent uses default", percent: 150, backends: 2, failing: 2, ejected: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			od := NewOutlierDetector(OutlierConfig{ConsecutiveErrors: 1, MaxEjectionPercent: tt.percent})
+			backends := newTestBackends(t, tt.backends)
+			for _, b := range backends[:tt.failing] {
+				failBackend(od, b, backends, 2)
+			}
+
+			ejected := 0
+			for _, b := range backends {
+				if b.IsEjected() {
+					ejected++
+				}
+			}
+			if ejected != tt.ejected {
+				t.Errorf("%d backends ejected, want %d", ejected, tt.ejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// errHelloPeeked stops the handshake once the ClientHello has been read
+var errHelloPeeked = errors.New("client hello peeked")
+
+// peekServerName reads the TLS ClientHello from a client connection
+// without decrypting anything and returns the requested server name.
+// The returned connection replays the consumed bytes, so the backend
+// sees the handshake from the start.
+func peekServerName(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// crypto/tls does the parsing, including ClientHellos that span
+	// several records; the handshake is abandoned before any reply
+	var consumed bytes.Buffer
+	var serverName string
+	var peeked bool
+	err := tls.Server(sniffConn{reader: io.TeeReader(conn, &consumed)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			peeked = true
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	if !peeked {
+		return "", nil, fmt.Errorf("reading client hello: %w", err)
+	}
+
+	return serverName, &peekedConn{Conn: conn, reader: io.MultiReader(&consumed, conn)}, nil
+}
+
+// sniffConn feeds a TLS server from a reader and discards its writes
+type sniffConn struct {
+	reader io.Reader
+}
+
+func (c sniffConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c sniffConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                       { return nil }
+func (c sniffConn) LocalAddr() net.Addr                { return nil }
+func (c sniffConn) RemoteAddr() net.Addr               { return nil }
+func (c sniffConn) SetDeadline(t time.Time) error      { return nil }
+func (c sniffConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c sniffConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays bytes read while peeking before reading the connection
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// closeWrite half-closes a connection if it supports it
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
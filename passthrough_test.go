@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first flight of a TLS client for the server
+// name, or without SNI when the name is empty
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	buf := make([]byte, 64*1024)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return buf[:n]
+}
+
+// peek runs peekServerName on a pipe fed by write
+func peek(t *testing.T, write func(net.Conn)) (string, net.Conn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go write(client)
+	return peekServerName(server, 2*time.Second)
+}
+
+func TestPeekServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+		chunk      int
+	}{
+		{name: "sni", serverName: "vault.example.com"},
+		{name: "no sni"},
+		{name: "hello split across reads", serverName: "a.k8s.example.com", chunk: 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := clientHello(t, tt.serverName)
+			rest := []byte("bytes after the hello")
+			serverName, conn, err := peek(t, func(c net.Conn) {
+				data := append(append([]byte{}, hello...), rest...)
+				for tt.chunk > 0 && len(data) > tt.chunk {
+					c.Write(data[:tt.chunk])
+					data = data[tt.chunk:]
+				}
+				c.Write(data)
+				c.Close()
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serverName != tt.serverName {
+				t.Errorf("server name = %q, want %q", serverName, tt.serverName)
+			}
+
+			// The backend sees the whole stream from its first byte
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := append(append([]byte{}, hello...), rest...); !bytes.Equal(got, want) {
+				t.Errorf("replayed %d bytes, want the %d-byte hello and the rest intact", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestPeekServerNameRejectsNonTLS(t *testing.T) {
+	_, conn, err := peek(t, func(c net.Conn) {
+		c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		c.Close()
+	})
+	if err == nil || conn != nil {
+		t.Errorf("plain text peeked as TLS: %v", err)
+	}
+
+	// A truncated hello is an error, not a server name
+	hello := clientHello(t, "vault.example.com")
+	_, _, err = peek(t, func(c net.Conn) {
+		c.Write(hello[:len(hello)/2])
+		c.Close()
+	})
+	if err == nil {
+		t.Error("truncated hello accepted")
+	}
+}
+
+func TestPeekServerNameTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	if _, _, err := peekServerName(server, 50*time.Millisecond); err == nil {
+		t.Fatal("silent client did not time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+}
+
+// The read deadline only covers the hello, not the proxied stream
+func TestPeekServerNameClearsDeadline(t *testing.T) {
+	hello := clientHello(t, "vault.example.com")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		client.Write(hello)
+		time.Sleep(150 * time.Millisecond)
+		client.Write([]byte("late"))
+	}()
+
+	_, conn, err := peekServerName(server, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(hello)+4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read after the hello timed out: %v", err)
+	}
+	if string(got[len(hello):]) != "late" {
+		t.Errorf("read %q after the hello, want \"late\"", got[len(hello):])
+	}
+}
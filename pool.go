@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultPool is the name of the pool built from the top-level backends
+const DefaultPool = "default"
+
+// Pool is a named group of backends with its own scheduler,
+// health checker and traffic policies
+type Pool struct {
+	name          string
+	backends      []*Backend
+	strategy      Strategy
+	sticky        *StickySessions
+	outliers      *OutlierDetector
+	retry         *RetryPolicy
+	headerRules   *HeaderRules
+	tlsConfig     *tls.Config
+	healthChecker *HealthChecker
+	config        PoolConfig
+	// TCP or UDP listener served by the pool, whose backends need a port
+	listener string
+	mu       sync.RWMutex
+}
+
+// NewPool creates a pool and its backends from configuration
+func NewPool(name string, config PoolConfig) (*Pool, error) {
+	pool := &Pool{
+		name:   name,
+		config: config,
+	}
+
+	strategy, err := NewStrategy(config.Algorithm, config.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", name, err)
+	}
+	pool.strategy = strategy
+
+	pool.retry, err = NewRetryPolicy(config.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", name, err)
+	}
+
+	pool.headerRules, err = NewHeaderRules(config.HeaderRules)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", name, err)
+	}
+
+	pool.tlsConfig, err = newUpstreamTLS(config.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", name, err)
+	}
+
+	switch config.SendProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return nil, fmt.Errorf("pool %s: unknown send_proxy_protocol version: %s", name, config.SendProxyProtocol)
+	}
+
+	if config.Sticky.Enabled {
+		pool.sticky = NewStickySessions(config.Sticky)
+	}
+	if config.OutlierDetection.Enabled {
+		pool.outliers = NewOutlierDetector(config.OutlierDetection)
+	}
+
+	backends := make([]*Backend, 0, len(config.Backends))
+	for _, bc := range config.Backends {
+		backend, err := pool.newBackend(bc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backend %s: %w", bc.URL, err)
+		}
+		backends = append(backends, backend)
+		log.Printf("Added backend to pool %s: %s (weight %d)", name, bc.URL, backend.Weight)
+	}
+	pool.backends = backends
+	// The checker keeps its own list; both are edited in place on removal
+	pool.healthChecker = NewHealthChecker(slices.Clone(backends), config.HealthCheckInterval)
+
+	log.Printf("Pool %s uses %s balancing algorithm", name, algorithmName(config.Algorithm))
+	return pool, nil
+}
+
+// newBackend creates a backend and attaches the pool-wide policies
+func (p *Pool) newBackend(bc BackendConfig) (*Backend, error) {
+	backend, err := NewBackend(bc)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	check := p.config.HealthCheck
+	listener := p.listener
+	p.mu.RUnlock()
+	if listener != "" && backend.URL.Port() == "" {
+		return nil, fmt.Errorf("%s needs a port on every backend", listener)
+	}
+	backend.healthOverride = bc.HealthCheck
+	backend.healthCheck, err = newBackendHealthCheck(backend, check)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.CircuitBreaker.Enabled {
+		backend.breaker = NewCircuitBreaker(backend.URL.String(), p.config.CircuitBreaker)
+	}
+	backend.proxyProtocol = p.config.SendProxyProtocol
+	backend.tlsConfig = p.tlsConfig
+	if backend.proxyProtocol != "" || backend.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = backend.dialContext
+		if backend.tlsConfig != nil {
+			transport.TLSClientConfig = backend.tlsConfig.Clone()
+		}
+		// A PROXY header describes a single client, so connections are not reused
+		transport.DisableKeepAlives = backend.proxyProtocol != ""
+		backend.ReverseProxy.Transport = transport
+	}
+	return backend, nil
+}
+
+// serveListener marks the pool as the pool of a TCP or UDP listener.
+// Those dial backends by address, so every backend must have a port;
+// this is checked for the current backends here and for backends added
+// later, through the API, a reload or the state file, in newBackend.
+func (p *Pool) serveListener(listener string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, backend := range p.backends {
+		if backend.URL.Port() == "" {
+			return fmt.Errorf("%s: backend %s has no port", listener, backend.URL)
+		}
+	}
+	p.listener = listener
+	return nil
+}
+
+// newBackendHealthCheck builds a backend's health check from the pool
+// settings and the backend's overrides
+func newBackendHealthCheck(backend *Backend, check HealthCheckConfig) (*HealthCheck, error) {
+	// Layer-4 backends are probed at their own protocol unless configured otherwise
+	if check.Type == "" {
+		switch backend.URL.Scheme {
+		case "tcp":
+			check.Type = HealthCheckTCP
+		case "udp":
+			check.Type = HealthCheckUDP
+		}
+	}
+	return NewHealthCheck(check, backend.healthOverride)
+}
+
+// Reconfigure applies the backend and health check settings of a
+// reloaded pool definition. Only backends added, removed or changed in
+// the configuration are touched, so backends managed through the API
+// stay in place.
+func (p *Pool) Reconfigure(config PoolConfig) error {
+	p.mu.Lock()
+	previous := p.config
+	p.config.HealthCheck = config.HealthCheck
+	p.config.HealthCheckPath = config.HealthCheckPath
+	p.config.HealthCheckInterval = config.HealthCheckInterval
+	p.config.Backends = config.Backends
+	p.mu.Unlock()
+
+	if !reflect.DeepEqual(previous.HealthCheck, config.HealthCheck) {
+		for _, backend := range p.GetBackends() {
+			check, err := newBackendHealthCheck(backend, config.HealthCheck)
+			if err != nil {
+				return fmt.Errorf("backend %s: %w", backend.URL, err)
+			}
+			backend.SetHealthCheck(check)
+		}
+		log.Printf("Pool %s health checks updated", p.name)
+	}
+	if previous.HealthCheckInterval != config.HealthCheckInterval {
+		p.healthChecker.SetInterval(config.HealthCheckInterval)
+		log.Printf("Pool %s health check interval updated", p.name)
+	}
+
+	// Changed backends are replaced, which resets their metrics. The file
+	// takes precedence over a backend of the same URL added through the API.
+	changed := changedBackends(previous.Backends, config.Backends)
+	for _, url := range changed {
+		p.RemoveBackend(url)
+	}
+	var errs []error
+	for _, bc := range config.Backends {
+		if slices.Contains(changed, bc.URL) {
+			if err := p.AddBackend(bc); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// changedBackends returns the URLs of backends added, removed or
+// redefined between two backend lists
+func changedBackends(previous, next []BackendConfig) []string {
+	current := make(map[string]BackendConfig, len(next))
+	for _, bc := range next {
+		current[bc.URL] = bc
+	}
+	var changed []string
+	for _, bc := range previous {
+		if nbc, ok := current[bc.URL]; ok && reflect.DeepEqual(bc, nbc) {
+			delete(current, bc.URL)
+			continue
+		}
+		changed = append(changed, bc.URL)
+	}
+	for _, bc := range next {
+		if _, ok := current[bc.URL]; ok && !slices.Contains(changed, bc.URL) {
+			changed = append(changed, bc.URL)
+		}
+	}
+	return changed
+}
+
+// Name returns the pool name
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Start starts the pool's health checker
+func (p *Pool) Start(ctx context.Context) {
+	go p.healthChecker.Start(ctx)
+}
+
+// GetNextBackend returns the next available backend chosen by the
+// configured balancing strategy, honouring session affinity if enabled
+func (p *Pool) GetNextBackend(r *http.Request) *Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.backends) == 0 {
+		return nil
+	}
+
+	if p.sticky != nil {
+		if backend := p.sticky.Backend(r, p.backends); backend != nil {
+			return backend
+		}
+	}
+
+	return p.strategy.Next(p.backends, r)
+}
+
+// hasCandidate reports whether the scheduler could still pick a backend for the request
+func (p *Pool) hasCandidate(r *http.Request) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, backend := range p.backends {
+		if isCandidate(r, backend) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP proxies a request to one of the pool's backends, retrying
+// failed attempts on another backend when the retry policy allows it
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	policy := p.retry
+	var body []byte
+	if policy != nil && policy.Allows(r) {
+		buffered, ok, err := bufferBody(r, policy.maxBodyBytes)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		body = buffered
+		if !ok {
+			policy = nil
+		}
+	} else {
+		policy = nil
+	}
+
+	// Pool rules run before the more specific route rules
+	var rules []*HeaderRules
+	if p.headerRules != nil {
+		rules = append(rules, p.headerRules)
+	}
+	info := requestInfoFrom(r.Context())
+	if info != nil && info.route != nil && info.route.headerRules != nil {
+		rules = append(rules, info.route.headerRules)
+	}
+
+	// Backends already tried for this request are excluded from scheduling
+	tried := make(map[*Backend]bool)
+	r = withExcluded(r, tried)
+
+	attempts := 0
+	for {
+		backend := p.GetNextBackend(r)
+		if backend == nil {
+			if attempts > 0 {
+				http.Error(w, "Bad gateway", http.StatusBadGateway)
+			} else {
+				http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			}
+			log.Printf("No healthy backends available in pool %s", p.name)
+			return
+		}
+		tried[backend] = true
+
+		// A half-open breaker may have handed its last trial to a concurrent request
+		generation, ok := backend.Admit()
+		if !ok {
+			log.Printf("Backend %s circuit breaker rejected request", backend.URL.String())
+			continue
+		}
+		attempts++
+
+		attempt := &proxyAttempt{generation: generation}
+		if policy != nil && attempts < policy.maxAttempts && p.hasCandidate(r) {
+			attempt.policy = policy
+		}
+
+		req := withAttempt(r, attempt)
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if rules != nil {
+			attempt.headers = &headerRewrite{rules: rules, request: r, backend: backend, pool: p.name, info: info}
+		}
+
+		p.proxy(w, req, backend, attempt)
+		if !attempt.retry {
+			return
+		}
+
+		backend.AddRetry()
+		if attempt.err != nil {
+			log.Printf("Retrying request to %s on another backend: %v", backend.URL.String(), attempt.err)
+		} else {
+			log.Printf("Retrying request to %s on another backend: status %d", backend.URL.String(), attempt.status)
+		}
+	}
+}
+
+// proxy forwards a single attempt to the backend and records its outcome
+func (p *Pool) proxy(w http.ResponseWriter, r *http.Request, backend *Backend, attempt *proxyAttempt) {
+	// The client is pinned once the backend has answered successfully
+	if p.sticky != nil {
+		attempt.pin = func(header http.Header) { p.sticky.Pin(header, r, backend) }
+	}
+
+	backend.IncrementConnections()
+	defer backend.DecrementConnections()
+
+	// The reverse proxy panics with http.ErrAbortHandler when copying the
+	// response body fails. The outcome is still recorded, otherwise a
+	// half-open breaker would never get its trial back.
+	start := time.Now()
+	defer func() {
+		latency := time.Since(start)
+		if err := recover(); err != nil {
+			if attempt.err == nil {
+				attempt.err = http.ErrAbortHandler
+			}
+			p.observe(backend, attempt.generation, attempt.failed(r), latency)
+			panic(err)
+		}
+		p.observe(backend, attempt.generation, attempt.failed(r), latency)
+		log.Printf("Proxied request to %s (latency: %v)", backend.URL.String(), latency)
+	}()
+	backend.ReverseProxy.ServeHTTP(w, r)
+}
+
+// observe records the outcome of a request or connection attempt admitted
+// in the given circuit breaker generation
+func (p *Pool) observe(backend *Backend, generation uint64, failed bool, latency time.Duration) {
+	backend.AddRequest(latency)
+
+	if p.outliers != nil {
+		p.outliers.Observe(backend, failed, p.GetBackends())
+	}
+	if backend.breaker != nil {
+		backend.breaker.Record(generation, failed, latency)
+	}
+}
+
+// GetMetrics returns metrics for all backends in the pool
+func (p *Pool) GetMetrics() []BackendMetrics {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	metrics := make([]BackendMetrics, 0, len(p.backends))
+	for _, backend := range p.backends {
+		m := backend.GetMetrics()
+		m.Pool = p.name
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// AddBackend adds a new backend to the pool
+func (p *Pool) AddBackend(bc BackendConfig) error {
+	backend, err := p.newBackend(bc)
+	if err != nil {
+		return fmt.Errorf("failed to create backend %s: %w", bc.URL, err)
+	}
+
+	p.mu.Lock()
+	for _, existing := range p.backends {
+		if existing.URL.String() == backend.URL.String() {
+			p.mu.Unlock()
+			return fmt.Errorf("backend already exists: %s", bc.URL)
+		}
+	}
+	p.backends = append(p.backends, backend)
+	p.mu.Unlock()
+
+	// Add to health checker
+	p.healthChecker.AddBackend(backend)
+
+	log.Printf("Added backend to pool %s: %s (weight %d)", p.name, bc.URL, backend.Weight)
+	return nil
+}
+
+// RemoveBackend removes a backend from the pool
+func (p *Pool) RemoveBackend(urlStr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, backend := range p.backends {
+		if backend.URL.String() == urlStr {
+			// Remove from backends slice
+			p.backends = append(p.backends[:i], p.backends[i+1:]...)
+
+			// Remove from health checker
+			p.healthChecker.RemoveBackend(backend)
+
+			log.Printf("Removed backend from pool %s: %s", p.name, urlStr)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("backend not found: %s", urlStr)
+}
+
+// configuredBackend returns the configuration file's definition of a
+// backend, or nil if the file does not list it
+func (p *Pool) configuredBackend(url string) *BackendConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, bc := range p.config.Backends {
+		if bc.URL == url {
+			return &bc
+		}
+	}
+	return nil
+}
+
+// GetBackends returns a copy of the pool's backends
+func (p *Pool) GetBackends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	backends := make([]*Backend, len(p.backends))
+	copy(backends, p.backends)
+	return backends
+}
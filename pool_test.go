@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayer4PoolsRequireBackendPorts(t *testing.T) {
+	config := &Config{
+		Pools: map[string]PoolConfig{
+			"web": {Backends: []BackendConfig{{URL: "http://10.0.0.1:8080"}}},
+			"tcp": {Backends: []BackendConfig{{URL: "tcp://10.0.1.1:5432"}}},
+			"udp": {Backends: []BackendConfig{{URL: "udp://10.0.2.1:53"}}},
+		},
+		TCPListeners: []TCPListenerConfig{{Name: "postgres", Listen: ":5432", Pool: "tcp"}},
+		UDPListeners: []UDPListenerConfig{{Name: "dns", Listen: ":53", Pool: "udp"}},
+	}
+	lb, err := NewLoadBalancer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pool string
+		url  string
+		err  string
+	}{
+		{pool: "web", url: "http://10.0.0.2"},
+		{pool: "tcp", url: "tcp://10.0.1.2:5432"},
+		{pool: "tcp", url: "tcp://10.0.1.3", err: "tcp listener postgres needs a port"},
+		{pool: "udp", url: "udp://10.0.2.2", err: "udp listener dns needs a port"},
+	}
+	for _, tt := range tests {
+		pool, err := lb.GetPool(tt.pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pool.AddBackend(BackendConfig{URL: tt.url})
+		if tt.err == "" && err != nil {
+			t.Errorf("adding %s: %v", tt.url, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("adding %s: error = %v, want %q", tt.url, err, tt.err)
+		}
+	}
+
+	// Reloads replace backends through the same path
+	pool, _ := lb.GetPool("tcp")
+	err = pool.Reconfigure(PoolConfig{Backends: []BackendConfig{{URL: "tcp://10.0.1.1:5432"}, {URL: "tcp://10.0.1.4"}}})
+	if err == nil {
+		t.Error("reconfiguring a tcp pool with a backend without a port succeeded")
+	}
+
+	// Portless backends in the configuration are rejected at startup
+	config.Pools["tcp"] = PoolConfig{Backends: []BackendConfig{{URL: "tcp://10.0.1.1"}}}
+	if _, err := NewLoadBalancer(config); err == nil || !strings.Contains(err.Error(), "has no port") {
+		t.Errorf("error = %v, want a missing port error", err)
+	}
+}
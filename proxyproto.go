@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions accepted by the "send_proxy_protocol" pool setting
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+const (
+	defaultProxyHeaderTimeout = 5 * time.Second
+	maxProxyV1Header          = 107
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/*
+ * @ ProxyProtocolListener accepts connections that may start with a
+ * PROXY protocol v1 or v2 header. Headers are only parsed on connections
+ * from trusted sources; everyone else is served as a plain connection,
+ * so a spoofed header is never believed
+ */
+type ProxyProtocolListener struct {
+	net.Listener
+	sources *TrustedProxies
+	timeout time.Duration
+}
+
+// NewProxyProtocolListener wraps a listener with PROXY protocol support
+func NewProxyProtocolListener(ln net.Listener, config ProxyProtocolConfig, trustedProxies []string) (*ProxyProtocolListener, error) {
+	// Sources default to the trusted proxies of the HTTP layer
+	entries := config.Sources
+	if len(entries) == 0 {
+		entries = trustedProxies
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("proxy_protocol requires sources or trusted_proxies")
+	}
+	sources, err := NewTrustedProxies(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(config.HeaderTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+
+	return &ProxyProtocolListener{Listener: ln, sources: sources, timeout: timeout}, nil
+}
+
+// Accept returns the next connection. The header is read lazily on the
+// connection's own goroutine so a slow client cannot stall Accept.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !l.sources.Trusts(host) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// proxyConn reports the addresses carried in the PROXY header
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	source net.Addr
+	dest   net.Addr
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.source, c.dest, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			c.err = fmt.Errorf("proxy protocol from %s: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader consumes a v1 or v2 header if one is present. A nil
+// source means the connection carries no header or describes itself
+// (v1 UNKNOWN, v2 LOCAL), so the real socket addresses apply.
+func readProxyHeader(r *bufio.Reader) (source, dest net.Addr, err error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(peek) == 0 {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.HasPrefix(peek, []byte("PROXY ")):
+		return readProxyV1(r)
+	case bytes.Equal(peek, proxyV2Signature):
+		return readProxyV2(r)
+	}
+	return nil, nil, nil
+}
+
+// readProxyV1 parses "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1Header {
+			return nil, nil, fmt.Errorf("v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("malformed v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header")
+	}
+
+	source, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dest, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, dest, nil
+}
+
+func parseProxyV1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readProxyV2 parses the binary header; TLVs are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: health checks from the proxy itself
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(payload) < 12 {
+			return nil, nil, fmt.Errorf("short v2 address block")
+		}
+		src := netip.AddrFrom4([4]byte(payload[0:4]))
+		dst := netip.AddrFrom4([4]byte(payload[4:8]))
+		return proxyV2Addrs(family, src, dst, payload[8:12])
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(payload) < 36 {
+			return nil, nil, fmt.Errorf("short v2 address block")
+		}
+		src := netip.AddrFrom16([16]byte(payload[0:16]))
+		dst := netip.AddrFrom16([16]byte(payload[16:32]))
+		return proxyV2Addrs(family, src, dst, payload[32:36])
+	}
+	// AF_UNSPEC and unix sockets carry no usable address
+	return nil, nil, nil
+}
+
+func proxyV2Addrs(family byte, src, dst netip.Addr, ports []byte) (net.Addr, net.Addr, error) {
+	source := netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports[0:2]))
+	dest := netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:4]))
+	if family&0x0f == 0x2 {
+		return net.UDPAddrFromAddrPort(source), net.UDPAddrFromAddrPort(dest), nil
+	}
+	return net.TCPAddrFromAddrPort(source), net.TCPAddrFromAddrPort(dest), nil
+}
+
+// proxyHeader builds the header sent to a backend. Without known
+// addresses it describes the connection itself (UNKNOWN / LOCAL).
+func proxyHeader(version string, source, dest netip.AddrPort) []byte {
+	known := source.IsValid() && dest.IsValid() && source.Addr().Is4() == dest.Addr().Is4()
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if !source.Addr().Is4() {
+			family = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family,
+			source.Addr(), dest.Addr(), source.Port(), dest.Port())
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		return append(header, 0x20, 0x00, 0x00, 0x00) // LOCAL, AF_UNSPEC
+	}
+	if source.Addr().Is4() {
+		header = append(header, 0x21, 0x11, 0x00, 12)
+		src, dst := source.Addr().As4(), dest.Addr().As4()
+		header = append(header, src[:]...)
+		header = append(header, dst[:]...)
+	} else {
+		header = append(header, 0x21, 0x21, 0x00, 36)
+		src, dst := source.Addr().As16(), dest.Addr().As16()
+		header = append(header, src[:]...)
+		header = append(header, dst[:]...)
+	}
+	header = binary.BigEndian.AppendUint16(header, source.Port())
+	return binary.BigEndian.AppendUint16(header, dest.Port())
+}
+
+// proxyHeaderAddrs returns the client and listener addresses of the
+// request being proxied, if the context belongs to one
+func proxyHeaderAddrs(ctx context.Context) (source, dest netip.AddrPort) {
+	info := requestInfoFrom(ctx)
+	if info == nil || info.forwarded == nil {
+		return
+	}
+	if addr, err := netip.ParseAddr(info.forwarded.clientIP); err == nil {
+		source = netip.AddrPortFrom(addr.Unmap(), info.forwarded.clientPort)
+	}
+	if local, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if addrPort, err := netip.ParseAddrPort(local.String()); err == nil {
+			dest = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+		}
+	}
+	return
+}
+
+// dialContext connects to the backend and, if the pool sends PROXY
+// protocol, writes the header before any other traffic
+func (b *Backend) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil || b.proxyProtocol == "" {
+		return conn, err
+	}
+
+	source, dest := proxyHeaderAddrs(ctx)
+	if _, err := conn.Write(proxyHeader(b.proxyProtocol, source, dest)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
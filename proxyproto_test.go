@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header with the given version/command byte, family
+// and payload, followed by application data
+func proxyV2(versionCommand, family byte, payload []byte, data string) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, versionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	header = append(header, payload...)
+	return string(header) + data
+}
+
+// addrBlock concatenates address bytes and big-endian ports
+func addrBlock(src, dst []byte, srcPort, dstPort uint16) []byte {
+	block := append(append([]byte(nil), src...), dst...)
+	block = binary.BigEndian.AppendUint16(block, srcPort)
+	return binary.BigEndian.AppendUint16(block, dstPort)
+}
+
+func describeAddr(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.Network() + " " + addr.String()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := addrBlock([]byte{192, 0, 2, 1}, []byte{198, 51, 100, 1}, 56324, 443)
+	v6src := netip.MustParseAddr("2001:db8::1").As16()
+	v6dst := netip.MustParseAddr("2001:db8::2").As16()
+	v6 := addrBlock(v6src[:], v6dst[:], 1000, 443)
+	// A NOOP TLV and a custom TLV after the IPv4 address block
+	tlvs := append(append([]byte(nil), v4...), 0x04, 0x00, 0x02, 0xaa, 0xbb, 0xe0, 0x00, 0x01, 0xcc)
+
+	tests := []struct {
+		name   string
+		input  string
+		source string
+		dest   string
+		err    bool
+		rest   string
+	}{
+		{
+			name:  "no header",
+			input: "GET / HTTP/1.1\r\n",
+			rest:  "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:   "v1 tcp4",
+			input:  "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /",
+			source: "tcp 192.0.2.1:56324",
+			dest:   "tcp 198.51.100.1:443",
+			rest:   "GET /",
+		},
+		{
+			name:   "v1 tcp6",
+			input:  "PROXY TCP6 2001:db8::1 2001:db8::2 1000 443\r\nGET /",
+			source: "tcp [2001:db8::1]:1000",
+			dest:   "tcp [2001:db8::2]:443",
+			rest:   "GET /",
+		},
+		{
+			name:  "v1 unknown",
+			input: "PROXY UNKNOWN\r\nGET /",
+			rest:  "GET /",
+		},
+		{
+			name:  "v1 unknown with addresses",
+			input: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nGET /",
+			rest:  "GET /",
+		},
+		{
+			name:  "v1 too long",
+			input: "PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n",
+			err:   true,
+		},
+		{
+			name:  "v1 without carriage return",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+			err:   true,
+		},
+		{
+			name:  "v1 unsupported family",
+			input: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			err:   true,
+		},
+		{
+			name:  "v1 missing fields",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+			err:   true,
+		},
+		{
+			name:  "v1 invalid address",
+			input: "PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n",
+			err:   true,
+		},
+		{
+			name:  "v1 port out of range",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n",
+			err:   true,
+		},
+		{
+			name:  "v1 truncated",
+			input: "PROXY TCP4 192.0.2.1",
+			err:   true,
+		},
+		{
+			name:   "v2 proxy tcp4",
+			input:  proxyV2(0x21, 0x11, v4, "GET /"),
+			source: "tcp 192.0.2.1:56324",
+			dest:   "tcp 198.51.100.1:443",
+			rest:   "GET /",
+		},
+		{
+			name:   "v2 proxy udp4",
+			input:  proxyV2(0x21, 0x12, v4, ""),
+			source: "udp 192.0.2.1:56324",
+			dest:   "udp 198.51.100.1:443",
+		},
+		{
+			name:   "v2 proxy tcp6",
+			input:  proxyV2(0x21, 0x21, v6, "GET /"),
+			source: "tcp [2001:db8::1]:1000",
+			dest:   "tcp [2001:db8::2]:443",
+			rest:   "GET /",
+		},
+		{
+			name:   "v2 proxy udp6",
+			input:  proxyV2(0x21, 0x22, v6, ""),
+			source: "udp [2001:db8::1]:1000",
+			dest:   "udp [2001:db8::2]:443",
+		},
+		{
+			name:  "v2 local tcp4",
+			input: proxyV2(0x20, 0x11, v4, "GET /"),
+			rest:  "GET /",
+		},
+		{
+			name:  "v2 local tcp6",
+			input: proxyV2(0x20, 0x21, v6, "GET /"),
+			rest:  "GET /",
+		},
+		{
+			name:  "v2 local unspec",
+			input: proxyV2(0x20, 0x00, nil, "GET /"),
+			rest:  "GET /",
+		},
+		{
+			name:  "v2 proxy unspec",
+			input: proxyV2(0x21, 0x00, nil, "GET /"),
+			rest:  "GET /",
+		},
+		{
+			name:  "v2 proxy unix",
+			input: proxyV2(0x21, 0x31, make([]byte, 216), "GET /"),
+			rest:  "GET /",
+		},
+		{
+			name:   "v2 tlvs skipped",
+			input:  proxyV2(0x21, 0x11, tlvs, "GET /"),
+			source: "tcp 192.0.2.1:56324",
+			dest:   "tcp 198.51.100.1:443",
+			rest:   "GET /",
+		},
+		{
+			name:  "v2 short ipv4 block",
+			input: proxyV2(0x21, 0x11, v4[:8], ""),
+			err:   true,
+		},
+		{
+			name:  "v2 short ipv6 block",
+			input: proxyV2(0x21, 0x21, v6[:20], ""),
+			err:   true,
+		},
+		{
+			name:  "v2 truncated payload",
+			input: proxyV2(0x21, 0x11, v4, "")[:20],
+			err:   true,
+		},
+		{
+			name:  "v2 truncated header",
+			input: string(proxyV2Signature) + "\x21",
+			err:   true,
+		},
+		{
+			name:  "v2 unsupported version",
+			input: proxyV2(0x11, 0x11, v4, ""),
+			err:   true,
+		},
+		{
+			name:  "v2 unsupported command",
+			input: proxyV2(0x22, 0x11, v4, ""),
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			source, dest, err := readProxyHeader(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got source %v dest %v", source, dest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := describeAddr(source); got != tt.source {
+				t.Errorf("source = %q, want %q", got, tt.source)
+			}
+			if got := describeAddr(dest); got != tt.dest {
+				t.Errorf("dest = %q, want %q", got, tt.dest)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != tt.rest {
+				t.Errorf("remaining data = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		source netip.AddrPort
+		dest   netip.AddrPort
+		known  bool
+	}{
+		{
+			name:   "ipv4",
+			source: netip.MustParseAddrPort("192.0.2.1:56324"),
+			dest:   netip.MustParseAddrPort("198.51.100.1:443"),
+			known:  true,
+		},
+		{
+			name:   "ipv6",
+			source: netip.MustParseAddrPort("[2001:db8::1]:1000"),
+			dest:   netip.MustParseAddrPort("[2001:db8::2]:443"),
+			known:  true,
+		},
+		{
+			name:   "mixed families",
+			source: netip.MustParseAddrPort("192.0.2.1:56324"),
+			dest:   netip.MustParseAddrPort("[2001:db8::2]:443"),
+		},
+		{
+			name: "no addresses",
+		},
+		{
+			name:   "no destination",
+			source: netip.MustParseAddrPort("192.0.2.1:56324"),
+		},
+	}
+
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, tt := range tests {
+			t.Run(version+" "+tt.name, func(t *testing.T) {
+				header := proxyHeader(version, tt.source, tt.dest)
+				r := bufio.NewReader(strings.NewReader(string(header) + "data"))
+				source, dest, err := readProxyHeader(r)
+				if err != nil {
+					t.Fatalf("reading %q: %v", header, err)
+				}
+
+				if !tt.known {
+					if source != nil || dest != nil {
+						t.Errorf("expected no addresses, got %v and %v", source, dest)
+					}
+				} else {
+					if got := source.(*net.TCPAddr).AddrPort(); got != tt.source {
+						t.Errorf("source = %v, want %v", got, tt.source)
+					}
+					if got := dest.(*net.TCPAddr).AddrPort(); got != tt.dest {
+						t.Errorf("dest = %v, want %v", got, tt.dest)
+					}
+				}
+
+				rest, _ := io.ReadAll(r)
+				if string(rest) != "data" {
+					t.Errorf("remaining data = %q, want %q", rest, "data")
+				}
+			})
+		}
+	}
+}
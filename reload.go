@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultConfigWatchInterval = 5 * time.Second
+
+/*
+ * @ ConfigReloader re-reads the configuration file on demand or when its
+ * contents change. A new configuration is fully validated before any of
+ * it is applied; backends, health checks and authentication take effect
+ * at once, and other changes are reported as needing a restart
+ */
+type ConfigReloader struct {
+	path    string
+	lb      *LoadBalancer
+	auth    *AuthManager
+	state   *StateStore
+	current Config
+	hash    [sha256.Size]byte
+	mu      sync.Mutex
+}
+
+// NewConfigReloader creates a reloader for the configuration the load
+// balancer was started with
+func NewConfigReloader(path string, config *Config, lb *LoadBalancer, auth *AuthManager, state *StateStore) *ConfigReloader {
+	r := &ConfigReloader{
+		path:    path,
+		lb:      lb,
+		auth:    auth,
+		state:   state,
+		current: *config,
+	}
+	r.current.Pools = maps.Clone(config.Pools)
+	if r.current.Pools == nil {
+		r.current.Pools = make(map[string]PoolConfig)
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		r.hash = sha256.Sum256(data)
+	}
+	return r
+}
+
+// Reload reads and applies the configuration file. An invalid file is
+// rejected as a whole and the running configuration is kept.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if data, err := os.ReadFile(r.path); err == nil {
+		r.hash = sha256.Sum256(data)
+	}
+	config, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+
+	fields := restartFields(&r.current, config)
+	if len(fields) > 0 {
+		log.Printf("Config reload: changes to %s require a restart and were not applied", strings.Join(fields, ", "))
+	}
+
+	var errs []error
+	for _, pool := range r.lb.GetPools() {
+		pc, ok := poolConfig(config, pool.Name())
+		// A pool that was added, removed or moved keeps running as it is
+		if !ok || slices.Contains(fields, "pools."+pool.Name()) ||
+			(pool.Name() == DefaultPool && slices.Contains(fields, "backends")) {
+			continue
+		}
+		if err := pool.Reconfigure(pc); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name(), err))
+		}
+		// Edits to the file supersede earlier API changes to the same backends
+		previous, _ := poolConfig(&r.current, pool.Name())
+		if err := r.state.Forget(pool.Name(), changedBackends(previous.Backends, pc.Backends)); err != nil {
+			errs = append(errs, fmt.Errorf("saving state: %w", err))
+		}
+		if pool.Name() == DefaultPool && len(r.current.Backends) > 0 {
+			r.current.PoolConfig = withPoolSettings(r.current.PoolConfig, pc)
+		} else {
+			r.current.Pools[pool.Name()] = withPoolSettings(r.current.Pools[pool.Name()], pc)
+		}
+	}
+	r.auth.Update(config.Auth)
+	r.current.Auth = config.Auth
+
+	log.Printf("Configuration reloaded from %s", r.path)
+	return errors.Join(errs...)
+}
+
+// Watch reloads the configuration whenever the file's contents change
+func (r *ConfigReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if r.changed() {
+				if err := r.Reload(); err != nil {
+					log.Printf("Config reload failed, keeping running configuration: %v", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// changed reports whether the file differs from the one last read.
+// Contents are compared rather than modification times, so editors that
+// replace the file and touches without edits behave the same.
+func (r *ConfigReloader) changed() bool {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(data)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return hash != r.hash
+}
+
+// validateConfig checks a configuration the way startup does, without
+// opening listeners or starting health checks
+func validateConfig(config *Config) error {
+	if _, err := NewLoadBalancer(config); err != nil {
+		return err
+	}
+	if config.EnableHTTPS {
+		if _, err := NewListenerTLS(config.ListenerTLS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// poolConfig returns the configuration of a pool by name
+func poolConfig(config *Config, name string) (PoolConfig, bool) {
+	if name == DefaultPool && len(config.Backends) > 0 {
+		return config.PoolConfig, true
+	}
+	pc, ok := config.Pools[name]
+	return pc, ok
+}
+
+// withPoolSettings copies the reloadable pool settings from src to dst
+func withPoolSettings(dst, src PoolConfig) PoolConfig {
+	dst.HealthCheckPath = src.HealthCheckPath
+	dst.HealthCheckInterval = src.HealthCheckInterval
+	dst.HealthCheck = src.HealthCheck
+	dst.Backends = src.Backends
+	return dst
+}
+
+// restartFields lists the settings that differ between two
+// configurations and cannot be applied while running
+func restartFields(running, next *Config) []string {
+	a, b := *running, *next
+	a.Auth, b.Auth = AuthConfig{}, AuthConfig{}
+	a.PoolConfig = withPoolSettings(a.PoolConfig, PoolConfig{})
+	b.PoolConfig = withPoolSettings(b.PoolConfig, PoolConfig{})
+	a.Pools, b.Pools = nil, nil
+
+	fields := diffFields(reflect.ValueOf(a), reflect.ValueOf(b))
+	// Adding or removing the default pool changes the pool set
+	if (len(running.Backends) > 0) != (len(next.Backends) > 0) {
+		fields = append(fields, "backends")
+	}
+
+	for name, pc := range running.Pools {
+		npc, ok := next.Pools[name]
+		if !ok {
+			fields = append(fields, "pools."+name)
+			continue
+		}
+		for _, field := range diffFields(reflect.ValueOf(withPoolSettings(pc, PoolConfig{})), reflect.ValueOf(withPoolSettings(npc, PoolConfig{}))) {
+			fields = append(fields, "pools."+name+"."+field)
+		}
+	}
+	for name := range next.Pools {
+		if _, ok := running.Pools[name]; !ok {
+			fields = append(fields, "pools."+name)
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// diffFields returns the JSON names of the struct fields that differ.
+// Fields of embedded structs are reported under their own names.
+func diffFields(a, b reflect.Value) []string {
+	var fields []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if field.Anonymous {
+			fields = append(fields, diffFields(a.Field(i), b.Field(i))...)
+			continue
+		}
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	return fields
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const reloadBaseConfig = `{
+	"port": 8080,
+	"algorithm": "round-robin",
+	"health_check_interval_seconds": 10,
+	"backends": [
+		{"url": "http://10.0.0.1:8080"},
+		{"url": "http://10.0.0.2:8080"},
+		{"url": "http://10.0.0.3:8080"}
+	],
+	"pools": {
+		"api": {"backends": [{"url": "http://10.0.1.1:8080"}]}
+	},
+	"frontends": [{"hosts": ["api.example.com"], "pool": "api"}]
+}`
+
+// newTestReloader starts a load balancer from the configuration text
+// and returns a reloader for its file
+func newTestReloader(t *testing.T, text string) (*ConfigReloader, *LoadBalancer, string) {
+	t.Helper()
+	path := writeTestFile(t, t.TempDir(), "config.json", []byte(text))
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConfigReloader(path, config, lb, NewAuthManager(&config.Auth), nil), lb, path
+}
+
+func backendURLs(pool *Pool) []string {
+	var urls []string
+	for _, backend := range pool.GetBackends() {
+		urls = append(urls, backend.URL.String())
+	}
+	slices.Sort(urls)
+	return urls
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "malformed json", text: `{"backends": [`},
+		{name: "invalid backend url", text: `{"backends": [{"url": "http://[::1"}]}`},
+		{name: "unknown frontend pool", text: `{"backends": [{"url": "http://10.0.0.1:8080"}], "frontends": [{"hosts": ["a.example.com"], "pool": "missing"}]}`},
+		{name: "invalid retry condition", text: `{"backends": [{"url": "http://10.0.0.1:8080"}], "retry": {"max_attempts": 2, "retry_on": ["404"]}}`},
+		{name: "no backends", text: `{"port": 8080}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloader, lb, path := newTestReloader(t, reloadBaseConfig)
+			running := reloader.current
+			pool, _ := lb.GetPool(DefaultPool)
+			backends := pool.GetBackends()
+
+			if err := os.WriteFile(path, []byte(tt.text), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := reloader.Reload(); err == nil {
+				t.Fatal("invalid configuration was accepted")
+			}
+
+			if !reflect.DeepEqual(reloader.current, running) {
+				t.Error("running configuration changed by a rejected reload")
+			}
+			if !slices.Equal(pool.GetBackends(), backends) {
+				t.Error("backends changed by a rejected reload")
+			}
+			// The file is not re-read until it changes again
+			if reloader.changed() {
+				t.Error("rejected file reported as changed again")
+			}
+		})
+	}
+}
+
+func TestReloadBackends(t *testing.T) {
+	reloader, lb, path := newTestReloader(t, reloadBaseConfig)
+	pool, _ := lb.GetPool(DefaultPool)
+	before := make(map[string]*Backend)
+	for _, backend := range pool.GetBackends() {
+		before[backend.URL.String()] = backend
+	}
+
+	// Keep .1, reweight .2, drop .3, add .4; the api pool gets a health check
+	next := `{
+		"port": 8080,
+		"algorithm": "round-robin",
+		"health_check_interval_seconds": 10,
+		"backends": [
+			{"url": "http://10.0.0.1:8080"},
+			{"url": "http://10.0.0.2:8080", "weight": 5},
+			{"url": "http://10.0.0.4:8080"}
+		],
+		"pools": {
+			"api": {"health_check": {"path": "/ready"}, "backends": [{"url": "http://10.0.1.1:8080"}]}
+		},
+		"frontends": [{"hosts": ["api.example.com"], "pool": "api"}]
+	}`
+	if err := os.WriteFile(path, []byte(next), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !reloader.changed() {
+		t.Fatal("edited file not reported as changed")
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.4:8080"}
+	if got := backendURLs(pool); !slices.Equal(got, want) {
+		t.Fatalf("backends = %v, want %v", got, want)
+	}
+	for _, backend := range pool.GetBackends() {
+		switch backend.URL.String() {
+		case "http://10.0.0.1:8080":
+			if backend != before["http://10.0.0.1:8080"] {
+				t.Error("unchanged backend was replaced")
+			}
+		case "http://10.0.0.2:8080":
+			if backend == before["http://10.0.0.2:8080"] || backend.Weight != 5 {
+				t.Errorf("edited backend not replaced: weight %d", backend.Weight)
+			}
+		}
+	}
+
+	api, _ := lb.GetPool("api")
+	if path := api.GetBackends()[0].HealthCheck().Path; path != "/ready" {
+		t.Errorf("api health check path = %q, want /ready", path)
+	}
+	if got := reloader.current.Pools["api"].HealthCheck.Path; got != "/ready" {
+		t.Errorf("running config not updated: health check path %q", got)
+	}
+	if !slices.EqualFunc(reloader.current.Backends, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.4:8080"}, func(bc BackendConfig, url string) bool { return bc.URL == url }) {
+		t.Errorf("running config backends = %v", reloader.current.Backends)
+	}
+}
+
+func TestReloadKeepsRestartSettings(t *testing.T) {
+	reloader, lb, path := newTestReloader(t, reloadBaseConfig)
+	pool, _ := lb.GetPool(DefaultPool)
+	strategy := pool.strategy
+
+	// A new port and algorithm need a restart; the new backend does not
+	next := `{
+		"port": 9090,
+		"algorithm": "least-connections",
+		"health_check_interval_seconds": 10,
+		"backends": [
+			{"url": "http://10.0.0.1:8080"},
+			{"url": "http://10.0.0.2:8080"},
+			{"url": "http://10.0.0.3:8080"},
+			{"url": "http://10.0.0.5:8080"}
+		],
+		"pools": {
+			"api": {"backends": [{"url": "http://10.0.1.1:8080"}]}
+		},
+		"frontends": [{"hosts": ["api.example.com"], "pool": "api"}]
+	}`
+	if err := os.WriteFile(path, []byte(next), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reloader.current.Port != 8080 || reloader.current.Algorithm != "round-robin" {
+		t.Errorf("restart settings applied: port %d, algorithm %q", reloader.current.Port, reloader.current.Algorithm)
+	}
+	if pool.strategy != strategy {
+		t.Error("pool strategy replaced without a restart")
+	}
+	if got := len(pool.GetBackends()); got != 4 {
+		t.Errorf("%d backends, want 4", got)
+	}
+}
+
+func TestRestartFields(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Port: 8080,
+			PoolConfig: PoolConfig{
+				Algorithm: "round-robin",
+				Backends:  []BackendConfig{{URL: "http://10.0.0.1:8080"}},
+			},
+			Pools: map[string]PoolConfig{
+				"api": {Algorithm: "round-robin", Backends: []BackendConfig{{URL: "http://10.0.1.1:8080"}}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   []string
+	}{
+		{name: "no change", change: func(*Config) {}},
+		{name: "top-level field", change: func(c *Config) { c.Port = 9090 }, want: []string{"port"}},
+		{name: "embedded pool field", change: func(c *Config) { c.Algorithm = "random" }, want: []string{"algorithm"}},
+		{name: "embedded https field", change: func(c *Config) { c.RedirectHTTPS = true }, want: []string{"redirect_https"}},
+		{name: "nested struct", change: func(c *Config) { c.CircuitBreaker.Enabled = true }, want: []string{"circuit_breaker"}},
+		{name: "reloadable pool settings", change: func(c *Config) {
+			c.Backends = append(c.Backends, BackendConfig{URL: "http://10.0.0.2:8080"})
+			c.HealthCheck.Path = "/ready"
+			c.HealthCheckInterval = time.Minute
+		}},
+		{name: "auth", change: func(c *Config) { c.Auth.Enabled = true }},
+		{name: "default pool removed", change: func(c *Config) { c.Backends = nil }, want: []string{"backends"}},
+		{name: "named pool setting", change: func(c *Config) {
+			api := c.Pools["api"]
+			api.Algorithm = "random"
+			api.Backends = nil
+			c.Pools["api"] = api
+		}, want: []string{"pools.api.algorithm"}},
+		{name: "pool added", change: func(c *Config) { c.Pools["web"] = PoolConfig{} }, want: []string{"pools.web"}},
+		{name: "pool removed", change: func(c *Config) { delete(c.Pools, "api") }, want: []string{"pools.api"}},
+		{name: "several", change: func(c *Config) {
+			c.Port = 9090
+			c.Frontends = []FrontendConfig{{Hosts: []string{"a.example.com"}, Pool: "api"}}
+			c.Pools["web"] = PoolConfig{}
+		}, want: []string{"frontends", "pools.web", "port"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := base()
+			tt.change(next)
+			if got := restartFields(base(), next); !slices.Equal(got, tt.want) {
+				t.Errorf("restartFields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	type inner struct {
+		A int `json:"a"`
+	}
+	type outer struct {
+		inner
+		B string   `json:"b,omitempty"`
+		C []string `json:"c"`
+	}
+
+	tests := []struct {
+		a, b outer
+		want []string
+	}{
+		{outer{}, outer{}, nil},
+		{outer{inner: inner{A: 1}}, outer{}, []string{"a"}},
+		{outer{B: "x"}, outer{B: "y"}, []string{"b"}},
+		{outer{C: []string{"x"}}, outer{C: []string{"x"}}, nil},
+		{outer{inner: inner{A: 1}, C: []string{"x"}}, outer{C: []string{"y"}}, []string{"a", "c"}},
+	}
+	for _, tt := range tests {
+		if got := diffFields(reflect.ValueOf(tt.a), reflect.ValueOf(tt.b)); !slices.Equal(got, tt.want) {
+			t.Errorf("diffFields(%+v, %+v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestChangedBackends(t *testing.T) {
+	a := BackendConfig{URL: "http://a"}
+	b := BackendConfig{URL: "http://b"}
+	b5 := BackendConfig{URL: "http://b", Weight: 5}
+	c := BackendConfig{URL: "http://c"}
+
+	tests := []struct {
+		name           string
+		previous, next []BackendConfig
+		want           []string
+	}{
+		{name: "unchanged", previous: []BackendConfig{a, b}, next: []BackendConfig{a, b}},
+		{name: "reordered", previous: []BackendConfig{a, b}, next: []BackendConfig{b, a}},
+		{name: "added", previous: []BackendConfig{a}, next: []BackendConfig{a, c}, want: []string{"http://c"}},
+		{name: "removed", previous: []BackendConfig{a, b}, next: []BackendConfig{a}, want: []string{"http://b"}},
+		{name: "replaced", previous: []BackendConfig{a, b}, next: []BackendConfig{a, b5}, want: []string{"http://b"}},
+		{name: "all", previous: []BackendConfig{a, b}, next: []BackendConfig{b5, c}, want: []string{"http://a", "http://b", "http://c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := changedBackends(tt.previous, tt.next)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("changedBackends = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolReconfigure(t *testing.T) {
+	pool, err := NewPool("api", PoolConfig{
+		HealthCheckInterval: time.Hour,
+		Backends:            []BackendConfig{{URL: "http://10.0.0.1:8080"}, {URL: "http://10.0.0.2:8080"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := pool.GetBackends()[0]
+
+	err = pool.Reconfigure(PoolConfig{
+		HealthCheckInterval: time.Minute,
+		HealthCheck:         HealthCheckConfig{Path: "/ready", ExpectedStatuses: []string{"200"}},
+		Backends:            []BackendConfig{{URL: "http://10.0.0.1:8080"}, {URL: "http://10.0.0.3:8080", Weight: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := backendURLs(pool), []string{"http://10.0.0.1:8080", "http://10.0.0.3:8080"}; !slices.Equal(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+	if pool.GetBackends()[0] != kept {
+		t.Error("unchanged backend was replaced")
+	}
+	for _, backend := range pool.GetBackends() {
+		if backend.HealthCheck().Path != "/ready" {
+			t.Errorf("%s health check path = %q, want /ready", backend.URL, backend.HealthCheck().Path)
+		}
+	}
+	pool.healthChecker.mu.RLock()
+	interval, checked := pool.healthChecker.interval, len(pool.healthChecker.backends)
+	pool.healthChecker.mu.RUnlock()
+	if interval != time.Minute {
+		t.Errorf("health check interval = %v, want 1m", interval)
+	}
+	if checked != 2 {
+		t.Errorf("health checker watches %d backends, want 2", checked)
+	}
+
+	// An invalid health check is reported and leaves the old one in place
+	if err := pool.Reconfigure(PoolConfig{HealthCheck: HealthCheckConfig{ExpectedBodyRegex: "("}, Backends: pool.config.Backends}); err == nil {
+		t.Error("invalid health check accepted")
+	}
+}
+
+func TestHealthCheckerSetInterval(t *testing.T) {
+	var checks atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+	}))
+	defer server.Close()
+
+	pool, err := NewPool("default", PoolConfig{Backends: []BackendConfig{{URL: server.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := NewHealthChecker(pool.GetBackends(), time.Hour)
+
+	// Updates before the checker starts do not block, and only the last counts
+	checker.SetInterval(time.Minute)
+	checker.SetInterval(20 * time.Millisecond)
+
+	ctx := t.Context()
+	go checker.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for checks.Load() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d checks, want the new interval to apply", checks.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Non-positive intervals fall back to the default
+	checker.SetInterval(0)
+	checker.mu.RLock()
+	interval := checker.interval
+	checker.mu.RUnlock()
+	if interval != defaultHealthCheckInterval {
+		t.Errorf("interval = %v, want the default %v", interval, defaultHealthCheckInterval)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Retry conditions accepted by "retry.retry_on" besides HTTP status codes
+const (
+	RetryOnConnectFailure = "connect-failure"
+	RetryOnReset          = "reset"
+)
+
+// Retry defaults
+var defaultRetryOn = []string{RetryOnConnectFailure, RetryOnReset, "502", "503", "504"}
+
+const defaultRetryBodyBytes = 64 * 1024
+
+// errRetryStatus aborts a proxied response whose status will be retried
+var errRetryStatus = errors.New("retryable upstream status")
+
+// RetryPolicy decides which failed requests are re-sent to another backend
+type RetryPolicy struct {
+	maxAttempts    int
+	connectFailure bool
+	reset          bool
+	statuses       map[int]bool
+	nonIdempotent  bool
+	maxBodyBytes   int64
+}
+
+// NewRetryPolicy validates the retry configuration and creates the policy.
+// It returns nil when retries are disabled.
+func NewRetryPolicy(config RetryConfig) (*RetryPolicy, error) {
+	if config.MaxAttempts <= 1 {
+		return nil, nil
+	}
+
+	policy := &RetryPolicy{
+		maxAttempts:   config.MaxAttempts,
+		statuses:      make(map[int]bool),
+		nonIdempotent: config.RetryNonIdempotent,
+		maxBodyBytes:  config.MaxBodyBytes,
+	}
+	if policy.maxBodyBytes <= 0 {
+		policy.maxBodyBytes = defaultRetryBodyBytes
+	}
+
+	retryOn := config.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, condition := range retryOn {
+		switch condition {
+		case RetryOnConnectFailure:
+			policy.connectFailure = true
+		case RetryOnReset:
+			policy.reset = true
+		default:
+			code, err := strconv.Atoi(condition)
+			if err != nil || code < 500 || code > 599 {
+				return nil, fmt.Errorf("invalid retry condition: %s", condition)
+			}
+			policy.statuses[code] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// Allows reports whether the request method may be retried
+func (p *RetryPolicy) Allows(r *http.Request) bool {
+	if p.nonIdempotent {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryOnError reports whether a transport error should be retried
+func (p *RetryPolicy) retryOnError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return p.connectFailure
+	}
+	return p.reset
+}
+
+// proxyAttempt tracks one attempt at proxying a request to a backend.
+// The reverse proxy hooks record the outcome and, while the policy allows
+// it, swallow failures instead of writing them to the client.
+type proxyAttempt struct {
+	policy     *RetryPolicy
+	generation uint64
+	status     int
+	err        error
+	retry      bool
+	headers    *headerRewrite
+	pin        func(http.Header)
+}
+
+// failed reports whether the attempt counts as a backend failure.
+// Transport errors caused by the client going away, such as
+// context.Canceled, are not held against the backend.
+func (a *proxyAttempt) failed(r *http.Request) bool {
+	if a.status >= http.StatusInternalServerError {
+		return true
+	}
+	return a.err != nil && r.Context().Err() == nil
+}
+
+type attemptKey struct{}
+
+// withAttempt attaches the attempt to the request context
+func withAttempt(r *http.Request, attempt *proxyAttempt) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), attemptKey{}, attempt))
+}
+
+func attemptFrom(ctx context.Context) *proxyAttempt {
+	attempt, _ := ctx.Value(attemptKey{}).(*proxyAttempt)
+	return attempt
+}
+
+// proxyModifyResponse records the upstream status and aborts responses
+// that are going to be retried on another backend
+func proxyModifyResponse(res *http.Response) error {
+	attempt := attemptFrom(res.Request.Context())
+	if attempt == nil {
+		return nil
+	}
+
+	attempt.status = res.StatusCode
+	if attempt.policy != nil && attempt.policy.statuses[res.StatusCode] && res.Request.Context().Err() == nil {
+		attempt.retry = true
+		return errRetryStatus
+	}
+	if attempt.headers != nil {
+		attempt.headers.Response(res.Header)
+	}
+	if attempt.pin != nil && res.StatusCode < http.StatusInternalServerError {
+		attempt.pin(res.Header)
+	}
+	return nil
+}
+
+// proxyErrorHandler replaces httputil's default handler so that retryable
+// failures are not written to the client
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	attempt := attemptFrom(r.Context())
+	if attempt != nil {
+		if errors.Is(err, errRetryStatus) {
+			return
+		}
+		attempt.err = err
+		if attempt.policy != nil && attempt.policy.retryOnError(err) && r.Context().Err() == nil {
+			attempt.retry = true
+			return
+		}
+	}
+
+	log.Printf("Proxy error: %v", err)
+	if attempt != nil && attempt.headers != nil {
+		attempt.headers.Response(w.Header())
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// bufferBody reads up to limit bytes of the request body so it can be
+// replayed. If the body is larger it is left intact and ok is false.
+func bufferBody(r *http.Request, limit int64) (body []byte, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	return buf, true, nil
+}
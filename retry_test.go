@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyAttemptFailed(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		status   int
+		err      error
+		canceled bool
+		want     bool
+	}{
+		{name: "success", status: http.StatusOK},
+		{name: "client error status", status: http.StatusNotFound},
+		{name: "server error status", status: http.StatusServiceUnavailable, want: true},
+		{name: "transport error", err: errors.New("connection reset by peer"), want: true},
+		{name: "client canceled", err: context.Canceled, canceled: true},
+		{name: "client gone during body copy", status: http.StatusOK, err: http.ErrAbortHandler, canceled: true},
+		{name: "server error status before client left", status: http.StatusBadGateway, canceled: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.canceled {
+				r = r.WithContext(canceled)
+			}
+			attempt := &proxyAttempt{status: tt.status, err: tt.err}
+			if got := attempt.failed(r); got != tt.want {
+				t.Errorf("failed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Clients hanging up on a slow backend must not open its breaker
+func TestPoolIgnoresClientCancellation(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	pool, err := NewPool("default", PoolConfig{
+		CircuitBreaker: CircuitBreakerConfig{Enabled: true, MinRequests: 1},
+		Backends:       []BackendConfig{{URL: backend.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	pool.ServeHTTP(httptest.NewRecorder(), r)
+
+	if state := pool.GetBackends()[0].breaker.Metrics().State; state != CircuitClosed.String() {
+		t.Errorf("breaker state = %s after a client cancellation, want closed", state)
+	}
+}
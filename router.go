@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+/*
+ * @ Route is a compiled routing rule. All configured predicates
+ * must match for a request to be sent to the route's pool
+ */
+type Route struct {
+	name        string
+	pool        *Pool
+	hosts       []string
+	prefix      string
+	exact       string
+	regex       *regexp.Regexp
+	methods     map[string]bool
+	headers     map[string]string
+	query       map[string]string
+	stripPrefix bool
+	headerRules *HeaderRules
+	clients     []string
+}
+
+// NewRoute compiles a route definition against the available pools
+func NewRoute(config RouteConfig, pools map[string]*Pool) (*Route, error) {
+	name := config.Name
+	if name == "" {
+		name = config.Pool
+	}
+
+	pool, ok := pools[config.Pool]
+	if !ok {
+		return nil, fmt.Errorf("route %s references unknown pool: %s", name, config.Pool)
+	}
+
+	set := 0
+	for _, p := range []string{config.PathPrefix, config.Path, config.PathRegex} {
+		if p != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("route %s: only one of path_prefix, path and path_regex may be set", name)
+	}
+	if config.StripPrefix && config.PathPrefix == "" {
+		return nil, fmt.Errorf("route %s: strip_prefix requires path_prefix", name)
+	}
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		return nil, fmt.Errorf("route %s: path_prefix must start with /", name)
+	}
+
+	route := &Route{
+		name:        name,
+		pool:        pool,
+		prefix:      config.PathPrefix,
+		exact:       config.Path,
+		headers:     config.Headers,
+		query:       config.Query,
+		stripPrefix: config.StripPrefix,
+		clients:     config.ClientIdentities,
+	}
+
+	rules, err := NewHeaderRules(config.HeaderRules)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %w", name, err)
+	}
+	route.headerRules = rules
+
+	for _, host := range config.Hosts {
+		route.hosts = append(route.hosts, strings.ToLower(host))
+	}
+
+	if config.PathRegex != "" {
+		re, err := regexp.Compile(config.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: invalid path_regex: %w", name, err)
+		}
+		route.regex = re
+	}
+
+	if len(config.Methods) > 0 {
+		route.methods = make(map[string]bool, len(config.Methods))
+		for _, method := range config.Methods {
+			route.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	return route, nil
+}
+
+// Matches reports whether the request satisfies every predicate of the route
+func (rt *Route) Matches(r *http.Request) bool {
+	if len(rt.hosts) > 0 {
+		host := requestHost(r)
+		matched := false
+		for _, pattern := range rt.hosts {
+			if hostMatches(pattern, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	path := r.URL.Path
+	if rt.prefix != "" && !pathHasPrefix(path, rt.prefix) {
+		return false
+	}
+	if rt.exact != "" && path != rt.exact {
+		return false
+	}
+	if rt.regex != nil && !rt.regex.MatchString(path) {
+		return false
+	}
+
+	if rt.methods != nil && !rt.methods[r.Method] {
+		return false
+	}
+
+	// An empty expected value only requires the header or parameter to be present
+	for name, value := range rt.headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || (value != "" && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+	if len(rt.query) > 0 {
+		query := r.URL.Query()
+		for name, value := range rt.query {
+			values, ok := query[name]
+			if !ok || (value != "" && !slices.Contains(values, value)) {
+				return false
+			}
+		}
+	}
+
+	// "*" accepts any verified client certificate
+	if len(rt.clients) > 0 {
+		cert := verifiedClientCert(r)
+		if cert == nil {
+			return false
+		}
+		if !slices.Contains(rt.clients, "*") && !slices.ContainsFunc(clientIdentities(cert), func(name string) bool {
+			return slices.Contains(rt.clients, name)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Rewrite returns the request as it should be sent to the pool,
+// removing the matched path prefix if the route strips it
+func (rt *Route) Rewrite(r *http.Request) *http.Request {
+	if !rt.stripPrefix {
+		return r
+	}
+
+	prefix := strings.TrimSuffix(rt.prefix, "/")
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = ensureLeadingSlash(strings.TrimPrefix(r.URL.Path, prefix))
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = ensureLeadingSlash(strings.TrimPrefix(r.URL.RawPath, prefix))
+	}
+	return r2
+}
+
+// pathHasPrefix matches prefix on path segment boundaries, so that
+// "/api" matches "/api" and "/api/users" but not "/apix"
+func pathHasPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// ensureLeadingSlash keeps rewritten paths absolute
+func ensureLeadingSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
+
+// hostTable maps host names to pools or per-host settings. Exact names
+// win over "*.example.com" wildcards, which are tried most specific
+// first: "*.api.example.com" before "*.example.com".
+type hostTable[T any] struct {
+	exact     map[string]T
+	wildcards []wildcardHost[T]
+}
+
+// wildcardHost maps a "*.example.com" pattern to its value
+type wildcardHost[T any] struct {
+	pattern string
+	value   T
+}
+
+// add maps a host name or wildcard to a value
+func (t *hostTable[T]) add(host string, value T) error {
+	host = strings.ToLower(host)
+	if strings.HasPrefix(host, "*.") {
+		if slices.ContainsFunc(t.wildcards, func(w wildcardHost[T]) bool { return w.pattern == host }) {
+			return fmt.Errorf("host %s is mapped to more than one pool", host)
+		}
+		// Wildcards with as many labels cannot match the same host, so
+		// sorting by label count fixes the order regardless of the config
+		labels := strings.Count(host, ".")
+		i := slices.IndexFunc(t.wildcards, func(w wildcardHost[T]) bool { return strings.Count(w.pattern, ".") < labels })
+		if i < 0 {
+			i = len(t.wildcards)
+		}
+		t.wildcards = slices.Insert(t.wildcards, i, wildcardHost[T]{pattern: host, value: value})
+		return nil
+	}
+	if t.exact == nil {
+		t.exact = make(map[string]T)
+	}
+	if _, exists := t.exact[host]; exists {
+		return fmt.Errorf("host %s is mapped to more than one pool", host)
+	}
+	t.exact[host] = value
+	return nil
+}
+
+// match returns the value for a lower-cased host name, or the zero value
+func (t *hostTable[T]) match(host string) T {
+	if value, ok := t.exact[host]; ok {
+		return value
+	}
+	for _, wildcard := range t.wildcards {
+		if hostMatches(wildcard.pattern, host) {
+			return wildcard.value
+		}
+	}
+	var zero T
+	return zero
+}
+
+// requestHost returns the lower-cased request host without port,
+// falling back to the TLS server name
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// hostMatches matches a host against an exact name or a "*.example.com" wildcard
+func hostMatches(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostTable(t *testing.T) {
+	var table hostTable[string]
+	for _, entry := range []struct{ host, value string }{
+		{"*.example.com", "wildcard"},
+		{"Shop.Example.com", "shop"},
+		{"*.eu.example.com", "eu"},
+		{"*.api.eu.example.com", "eu-api"},
+		{"example.org", "org"},
+	} {
+		if err := table.add(entry.host, entry.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"shop.example.com", "shop"},
+		{"blog.example.com", "wildcard"},
+		{"a.b.example.com", "wildcard"},
+		// The most specific wildcard wins, whatever the config order
+		{"shop.eu.example.com", "eu"},
+		{"v1.api.eu.example.com", "eu-api"},
+		{"api.eu.example.com", "eu"},
+		// A wildcard does not match its own base name
+		{"example.com", ""},
+		{"eu.example.com", "wildcard"},
+		{"example.org", "org"},
+		{"www.example.org", ""},
+		{"notexample.com", ""},
+	}
+	for _, tt := range tests {
+		if got := table.match(tt.host); got != tt.want {
+			t.Errorf("match(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+
+	for _, host := range []string{"shop.example.com", "*.EU.example.com"} {
+		if err := table.add(host, "again"); err == nil {
+			t.Errorf("%s mapped twice", host)
+		}
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	tests := []struct {
+		host       string
+		serverName string
+		want       string
+	}{
+		{host: "Shop.Example.com", want: "shop.example.com"},
+		{host: "shop.example.com:8443", want: "shop.example.com"},
+		{host: "shop.example.com.", want: "shop.example.com"},
+		{host: "[2001:db8::1]:8080", want: "2001:db8::1"},
+		{serverName: "SNI.example.com", want: "sni.example.com"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		if tt.serverName != "" {
+			r.TLS = &tls.ConnectionState{ServerName: tt.serverName}
+		}
+		if got := requestHost(r); got != tt.want {
+			t.Errorf("requestHost(host %q, sni %q) = %q, want %q", tt.host, tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestLoadBalancerRoutesByHost(t *testing.T) {
+	lb, err := NewLoadBalancer(&Config{
+		PoolConfig: PoolConfig{Backends: []BackendConfig{{URL: "http://10.0.0.1:8080"}}},
+		Pools: map[string]PoolConfig{
+			"shop":    {Backends: []BackendConfig{{URL: "http://10.0.1.1:8080"}}},
+			"tenants": {Backends: []BackendConfig{{URL: "http://10.0.2.1:8080"}}},
+			"eu":      {Backends: []BackendConfig{{URL: "http://10.0.3.1:8080"}}},
+		},
+		Frontends: []FrontendConfig{
+			{Hosts: []string{"*.example.com"}, Pool: "tenants"},
+			{Hosts: []string{"shop.example.com"}, Pool: "shop"},
+			{Hosts: []string{"*.eu.example.com"}, Pool: "eu"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]string{
+		"shop.example.com":    "shop",
+		"acme.example.com":    "tenants",
+		"acme.eu.example.com": "eu",
+		"example.com":         DefaultPool,
+		"other.test":          DefaultPool,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		pool, _, _ := lb.Route(r)
+		if pool == nil || pool.Name() != want {
+			t.Errorf("%s routed to %v, want %s", host, pool, want)
+		}
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	pools := map[string]*Pool{"api": nil}
+	client := &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, DNSNames: []string{"billing.internal"}}
+
+	tests := []struct {
+		name   string
+		config RouteConfig
+		method string
+		target string
+		header http.Header
+		client *x509.Certificate
+		want   bool
+	}{
+		{name: "no predicates", want: true},
+		{name: "host", config: RouteConfig{Hosts: []string{"API.example.com"}}, target: "http://api.example.com:8080/", want: true},
+		{name: "other host", config: RouteConfig{Hosts: []string{"api.example.com"}}, target: "http://www.example.com/"},
+		{name: "wildcard host", config: RouteConfig{Hosts: []string{"*.example.com"}}, target: "http://v2.api.example.com/", want: true},
+		{name: "prefix", config: RouteConfig{PathPrefix: "/api"}, target: "/api/users", want: true},
+		{name: "prefix itself", config: RouteConfig{PathPrefix: "/api"}, target: "/api", want: true},
+		{name: "prefix is not a segment", config: RouteConfig{PathPrefix: "/api"}, target: "/apix"},
+		{name: "prefix with trailing slash", config: RouteConfig{PathPrefix: "/api/"}, target: "/api/users", want: true},
+		{name: "prefix with trailing slash needs it", config: RouteConfig{PathPrefix: "/api/"}, target: "/api"},
+		{name: "exact path", config: RouteConfig{Path: "/login"}, target: "/login", want: true},
+		{name: "exact path below", config: RouteConfig{Path: "/login"}, target: "/login/sso"},
+		{name: "regex", config: RouteConfig{PathRegex: `^/users/\d+$`}, target: "/users/42", want: true},
+		{name: "regex mismatch", config: RouteConfig{PathRegex: `^/users/\d+$`}, target: "/users/me"},
+		{name: "regex on the decoded path", config: RouteConfig{PathRegex: `^/files/a b$`}, target: "/files/a%20b", want: true},
+		{name: "method", config: RouteConfig{Methods: []string{"post", "PUT"}}, method: "POST", want: true},
+		{name: "other method", config: RouteConfig{Methods: []string{"POST"}}, method: "GET"},
+		{name: "header value", config: RouteConfig{Headers: map[string]string{"X-Version": "2"}}, header: http.Header{"X-Version": {"1", "2"}}, want: true},
+		{name: "header other value", config: RouteConfig{Headers: map[string]string{"X-Version": "2"}}, header: http.Header{"X-Version": {"1"}}},
+		{name: "header present", config: RouteConfig{Headers: map[string]string{"X-Debug": ""}}, header: http.Header{"X-Debug": {""}}, want: true},
+		{name: "header missing", config: RouteConfig{Headers: map[string]string{"X-Debug": ""}}},
+		{name: "query value", config: RouteConfig{Query: map[string]string{"beta": "1"}}, target: "/?beta=1", want: true},
+		{name: "query other value", config: RouteConfig{Query: map[string]string{"beta": "1"}}, target: "/?beta=0"},
+		{name: "query present", config: RouteConfig{Query: map[string]string{"beta": ""}}, target: "/?beta", want: true},
+		{name: "query missing", config: RouteConfig{Query: map[string]string{"beta": ""}}, target: "/?alpha=1"},
+		{name: "client identity", config: RouteConfig{ClientIdentities: []string{"billing.internal"}}, client: client, want: true},
+		{name: "any client", config: RouteConfig{ClientIdentities: []string{"*"}}, client: client, want: true},
+		{name: "other client", config: RouteConfig{ClientIdentities: []string{"orders"}}, client: client},
+		{name: "no client certificate", config: RouteConfig{ClientIdentities: []string{"*"}}},
+		{
+			name:   "all predicates",
+			config: RouteConfig{Hosts: []string{"api.example.com"}, PathPrefix: "/v2", Methods: []string{"GET"}, Headers: map[string]string{"Accept": "application/json"}},
+			target: "http://api.example.com/v2/orders", header: http.Header{"Accept": {"application/json"}}, want: true,
+		},
+		{
+			name:   "all but one predicate",
+			config: RouteConfig{Hosts: []string{"api.example.com"}, PathPrefix: "/v2", Methods: []string{"GET"}, Headers: map[string]string{"Accept": "application/json"}},
+			target: "http://api.example.com/v2/orders", header: http.Header{"Accept": {"text/html"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Pool = "api"
+			route, err := NewRoute(tt.config, pools)
+			if err != nil {
+				t.Fatal(err)
+			}
+			method, target := tt.method, tt.target
+			if method == "" {
+				method = "GET"
+			}
+			if target == "" {
+				target = "/"
+			}
+			r := httptest.NewRequest(method, target, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if tt.client != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.client}}}
+			}
+			if got := route.Matches(r); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRouteValidation(t *testing.T) {
+	pools := map[string]*Pool{"api": nil}
+	for _, config := range []RouteConfig{
+		{Pool: "missing"},
+		{Pool: "api", PathPrefix: "/api", Path: "/api"},
+		{Pool: "api", Path: "/api", PathRegex: "^/api"},
+		{Pool: "api", StripPrefix: true},
+		{Pool: "api", Path: "/api", StripPrefix: true},
+		{Pool: "api", PathPrefix: "api"},
+		{Pool: "api", PathRegex: "("},
+		{Pool: "api", HeaderRules: HeaderRulesConfig{Request: HeaderOpsConfig{Set: map[string]string{"X-Id": "{unknown}"}}}},
+	} {
+		if _, err := NewRoute(config, pools); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+}
+
+func TestRouteStripPrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		target   string
+		path     string
+		rawPath  string
+		escaped  string
+		rawQuery string
+	}{
+		{prefix: "/api", target: "/api/users", path: "/users", escaped: "/users"},
+		{prefix: "/api/", target: "/api/users", path: "/users", escaped: "/users"},
+		{prefix: "/api", target: "/api", path: "/", escaped: "/"},
+		{prefix: "/api", target: "/api/users?page=2", path: "/users", escaped: "/users", rawQuery: "page=2"},
+		// Encoded slashes survive in the raw path
+		{prefix: "/api", target: "/api/files/a%2Fb", path: "/files/a/b", rawPath: "/files/a%2Fb", escaped: "/files/a%2Fb"},
+		// A prefix that is encoded in the raw path still strips the decoded path
+		{prefix: "/my files", target: "/my%20files/report", path: "/report", escaped: "/report"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			route, err := NewRoute(RouteConfig{Pool: "api", PathPrefix: tt.prefix, StripPrefix: true}, map[string]*Pool{"api": nil})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", tt.target, nil)
+			original := *r.URL
+			if !route.Matches(r) {
+				t.Fatal("route does not match")
+			}
+
+			out := route.Rewrite(r)
+			if out.URL.Path != tt.path || out.URL.RawPath != tt.rawPath {
+				t.Errorf("path = %q raw %q, want %q raw %q", out.URL.Path, out.URL.RawPath, tt.path, tt.rawPath)
+			}
+			if got := out.URL.EscapedPath(); got != tt.escaped {
+				t.Errorf("escaped path = %q, want %q", got, tt.escaped)
+			}
+			if out.URL.RawQuery != tt.rawQuery {
+				t.Errorf("query = %q, want %q", out.URL.RawQuery, tt.rawQuery)
+			}
+			// The incoming request is left alone for logging and metrics
+			if *r.URL != original {
+				t.Errorf("incoming URL changed to %s", r.URL)
+			}
+		})
+	}
+
+	// Routes without strip_prefix pass the request through
+	route, _ := NewRoute(RouteConfig{Pool: "api", PathPrefix: "/api"}, map[string]*Pool{"api": nil})
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	if route.Rewrite(r) != r {
+		t.Error("request copied without strip_prefix")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+/*
+ * @ StateStore persists backend changes made through the API in a state
+ * file, as an overlay on the configuration file. The latest change to a
+ * backend wins: an overlay entry remembers the configuration file's
+ * definition it replaced and is dropped once the file defines the
+ * backend differently, whether edited while running or while stopped
+ */
+type StateStore struct {
+	path  string
+	state backendState
+	mu    sync.Mutex
+}
+
+// backendState is the state file format: per pool, the backends added
+// through the API and the backends removed through it
+type backendState struct {
+	Pools map[string]*poolState `json:"pools"`
+}
+
+type poolState struct {
+	Added   []addedBackend   `json:"added,omitempty"`
+	Removed []removedBackend `json:"removed,omitempty"`
+}
+
+// addedBackend is a backend added through the API. Configured is the
+// configuration file's backend of the same URL it replaced, if any.
+type addedBackend struct {
+	BackendConfig
+	Configured *BackendConfig `json:"configured,omitempty"`
+}
+
+// removedBackend is a configured backend removed through the API
+type removedBackend struct {
+	URL        string         `json:"url"`
+	Configured *BackendConfig `json:"configured"`
+}
+
+// NewStateStore loads the state file, or returns nil when no state file
+// is configured. A missing file is an empty overlay.
+func NewStateStore(path string) (*StateStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	s := &StateStore{path: path, state: backendState{Pools: make(map[string]*poolState)}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("state file %s: %w", path, err)
+	}
+	if s.state.Pools == nil {
+		s.state.Pools = make(map[string]*poolState)
+	}
+	return s, nil
+}
+
+// Apply replays the overlay onto the pools loaded from the configuration.
+// Entries for backends the configuration file changed since they were
+// recorded are dropped, leaving the file's definition in place.
+func (s *StateStore) Apply(lb *LoadBalancer) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, ps := range s.state.Pools {
+		pool, err := lb.GetPool(name)
+		if err != nil {
+			log.Printf("State file: skipping changes to unknown pool %s", name)
+			continue
+		}
+		stale := func(url string, configured *BackendConfig) bool {
+			if reflect.DeepEqual(pool.configuredBackend(url), configured) {
+				return false
+			}
+			log.Printf("State file: backend %s in pool %s changed in the config file since it was changed through the API; using the config file", url, name)
+			return true
+		}
+
+		ps.Removed = slices.DeleteFunc(ps.Removed, func(rb removedBackend) bool {
+			return stale(rb.URL, rb.Configured)
+		})
+		for _, rb := range ps.Removed {
+			pool.RemoveBackend(rb.URL)
+		}
+		ps.Added = slices.DeleteFunc(ps.Added, func(ab addedBackend) bool {
+			return stale(ab.URL, ab.Configured)
+		})
+		for _, ab := range ps.Added {
+			// Replaces the configured backend of the same URL, if any
+			pool.RemoveBackend(ab.URL)
+			if err := pool.AddBackend(ab.BackendConfig); err != nil {
+				log.Printf("State file: %v", err)
+			}
+		}
+	}
+	return s.save()
+}
+
+// Added records a backend added through the API
+func (s *StateStore) Added(pool *Pool, bc BackendConfig) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := s.pool(pool.Name())
+	ps.Removed = slices.DeleteFunc(ps.Removed, func(rb removedBackend) bool { return rb.URL == bc.URL })
+	ps.Added = slices.DeleteFunc(ps.Added, func(ab addedBackend) bool { return ab.URL == bc.URL })
+	ps.Added = append(ps.Added, addedBackend{BackendConfig: bc, Configured: pool.configuredBackend(bc.URL)})
+	return s.save()
+}
+
+// Removed records a backend removed through the API. Removing a backend
+// that only the API added just forgets it.
+func (s *StateStore) Removed(pool *Pool, url string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := s.pool(pool.Name())
+	ps.Added = slices.DeleteFunc(ps.Added, func(ab addedBackend) bool { return ab.URL == url })
+	if configured := pool.configuredBackend(url); configured != nil &&
+		!slices.ContainsFunc(ps.Removed, func(rb removedBackend) bool { return rb.URL == url }) {
+		ps.Removed = append(ps.Removed, removedBackend{URL: url, Configured: configured})
+	}
+	return s.save()
+}
+
+// Forget drops the overlay entries of backends the configuration file
+// now defines differently, since the file was edited after them
+func (s *StateStore) Forget(pool string, urls []string) error {
+	if s == nil || len(urls) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps, ok := s.state.Pools[pool]
+	if !ok {
+		return nil
+	}
+	before := len(ps.Added) + len(ps.Removed)
+	ps.Added = slices.DeleteFunc(ps.Added, func(ab addedBackend) bool { return slices.Contains(urls, ab.URL) })
+	ps.Removed = slices.DeleteFunc(ps.Removed, func(rb removedBackend) bool { return slices.Contains(urls, rb.URL) })
+	if len(ps.Added)+len(ps.Removed) == before {
+		return nil
+	}
+	return s.save()
+}
+
+// pool returns the overlay of a pool, creating it if needed
+func (s *StateStore) pool(name string) *poolState {
+	ps, ok := s.state.Pools[name]
+	if !ok {
+		ps = &poolState{}
+		s.state.Pools[name] = ps
+	}
+	return ps
+}
+
+// save writes the state file atomically, leaving out empty pools
+func (s *StateStore) save() error {
+	for name, ps := range s.state.Pools {
+		if len(ps.Added) == 0 && len(ps.Removed) == 0 {
+			delete(s.state.Pools, name)
+		}
+	}
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(data, '\n'))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stateTestConfig is a configuration file listing backends a and b
+const stateTestConfig = `{
+	"backends": [
+		{"url": "http://10.0.0.1:8080", "weight": 1},
+		{"url": "http://10.0.0.2:8080", "weight": 1}
+	]
+}`
+
+const (
+	backendA = "http://10.0.0.1:8080"
+	backendB = "http://10.0.0.2:8080"
+	backendC = "http://10.0.0.3:8080"
+)
+
+// startWithState starts a load balancer from the configuration text and
+// replays the state file over it, as main does
+func startWithState(t *testing.T, text, statePath string) (*Pool, *StateStore) {
+	t.Helper()
+	var config Config
+	if err := json.Unmarshal([]byte(text), &config); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := NewStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Apply(lb); err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := lb.GetPool(DefaultPool)
+	return pool, state
+}
+
+// apiAdd and apiRemove change a pool the way the API handlers do
+func apiAdd(t *testing.T, pool *Pool, state *StateStore, bc BackendConfig) {
+	t.Helper()
+	if err := pool.AddBackend(bc); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Added(pool, bc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func apiRemove(t *testing.T, pool *Pool, state *StateStore, url string) {
+	t.Helper()
+	if err := pool.RemoveBackend(url); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Removed(pool, url); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// weights returns the weight of every backend in the pool by URL
+func weights(pool *Pool) map[string]int {
+	weights := make(map[string]int)
+	for _, backend := range pool.GetBackends() {
+		weights[backend.URL.String()] = backend.Weight
+	}
+	return weights
+}
+
+func readState(t *testing.T, path string) backendState {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state backendState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestStateStoreNotConfigured(t *testing.T) {
+	state, err := NewStateStore("")
+	if state != nil || err != nil {
+		t.Fatalf("NewStateStore(\"\") = %v, %v", state, err)
+	}
+	// A nil store accepts every change without persisting it
+	if err := state.Added(nil, BackendConfig{}); err != nil {
+		t.Error(err)
+	}
+	if err := state.Removed(nil, backendA); err != nil {
+		t.Error(err)
+	}
+	if err := state.Forget(DefaultPool, []string{backendA}); err != nil {
+		t.Error(err)
+	}
+	if err := state.Apply(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// Replacing a configured backend through the API survives a restart
+func TestStateStoreOverridesConfiguredBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	pool, state := startWithState(t, stateTestConfig, path)
+	apiRemove(t, pool, state, backendA)
+	apiAdd(t, pool, state, BackendConfig{URL: backendA, Weight: 3})
+	apiRemove(t, pool, state, backendB)
+
+	saved := readState(t, path).Pools[DefaultPool]
+	if len(saved.Added) != 1 || saved.Added[0].Configured == nil || saved.Added[0].Configured.Weight != 1 {
+		t.Fatalf("added entries = %+v, want a recording the configured weight", saved.Added)
+	}
+	if len(saved.Removed) != 1 || saved.Removed[0].URL != backendB {
+		t.Fatalf("removed entries = %+v, want only b", saved.Removed)
+	}
+
+	pool, _ = startWithState(t, stateTestConfig, path)
+	got := weights(pool)
+	if len(got) != 1 || got[backendA] != 3 {
+		t.Errorf("backends after restart = %v, want only a with weight 3", got)
+	}
+}
+
+// Removing a backend only the API added leaves nothing behind
+func TestStateStoreRemovesAPIOnlyBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	pool, state := startWithState(t, stateTestConfig, path)
+	apiAdd(t, pool, state, BackendConfig{URL: backendC, Weight: 2})
+	if added := readState(t, path).Pools[DefaultPool].Added; len(added) != 1 || added[0].Configured != nil {
+		t.Fatalf("added entries = %+v, want c without a configured definition", added)
+	}
+
+	apiRemove(t, pool, state, backendC)
+	if pools := readState(t, path).Pools; len(pools) != 0 {
+		t.Errorf("state = %+v, want it empty", pools)
+	}
+
+	pool, _ = startWithState(t, stateTestConfig, path)
+	if got := weights(pool); len(got) != 2 || got[backendA] != 1 || got[backendB] != 1 {
+		t.Errorf("backends after restart = %v, want the configured a and b", got)
+	}
+}
+
+// A config file edited while stopped wins over older API changes to the
+// same backends, and only those
+func TestStateStoreApplyDropsStaleEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	pool, state := startWithState(t, stateTestConfig, path)
+	apiRemove(t, pool, state, backendA)
+	apiAdd(t, pool, state, BackendConfig{URL: backendA, Weight: 3})
+	apiRemove(t, pool, state, backendB)
+	apiAdd(t, pool, state, BackendConfig{URL: backendC, Weight: 2})
+
+	edited := `{
+		"backends": [
+			{"url": "http://10.0.0.1:8080", "weight": 5},
+			{"url": "http://10.0.0.2:8080", "weight": 4}
+		]
+	}`
+	pool, _ = startWithState(t, edited, path)
+	got := weights(pool)
+	if len(got) != 3 || got[backendA] != 5 || got[backendB] != 4 || got[backendC] != 2 {
+		t.Errorf("backends after restart = %v, want the file's a and b and the API's c", got)
+	}
+
+	saved := readState(t, path).Pools[DefaultPool]
+	if len(saved.Removed) != 0 || len(saved.Added) != 1 || saved.Added[0].URL != backendC {
+		t.Errorf("state = %+v, want only the API's c", saved)
+	}
+}
+
+// Editing a backend in the running config file supersedes the API's
+// change to it, both live and after a restart
+func TestStateStoreForgetOnReload(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeTestFile(t, dir, "config.json", []byte(stateTestConfig))
+	statePath := filepath.Join(dir, "state.json")
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLoadBalancer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := NewStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := lb.GetPool(DefaultPool)
+	reloader := NewConfigReloader(configPath, config, lb, NewAuthManager(&config.Auth), state)
+
+	apiRemove(t, pool, state, backendA)
+	apiAdd(t, pool, state, BackendConfig{URL: backendA, Weight: 3})
+	apiAdd(t, pool, state, BackendConfig{URL: backendC, Weight: 2})
+
+	edited := `{
+		"backends": [
+			{"url": "http://10.0.0.1:8080", "weight": 5},
+			{"url": "http://10.0.0.2:8080", "weight": 1}
+		]
+	}`
+	writeTestFile(t, dir, "config.json", []byte(edited))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := weights(pool)
+	if len(got) != 3 || got[backendA] != 5 || got[backendB] != 1 || got[backendC] != 2 {
+		t.Errorf("backends after reload = %v, want the file's a and b and the API's c", got)
+	}
+	saved := readState(t, statePath).Pools[DefaultPool]
+	if len(saved.Removed) != 0 || len(saved.Added) != 1 || saved.Added[0].URL != backendC {
+		t.Errorf("state = %+v, want only the API's c", saved)
+	}
+
+	pool, _ = startWithState(t, edited, statePath)
+	if restarted := weights(pool); len(restarted) != 3 || restarted[backendA] != 5 || restarted[backendC] != 2 {
+		t.Errorf("backends after restart = %v, want the file's a and the API's c", restarted)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+)
+
+// defaultStickyCookie is the affinity cookie name when none is configured
+const defaultStickyCookie = "fluxlb_affinity"
+
+// stickyIDSize is the length in bytes of the backend ID in the cookie
+const stickyIDSize = 16
+
+// StickySessions pins clients to a backend with an affinity cookie.
+// The cookie holds an HMAC of the backend URL rather than the URL itself,
+// so clients learn nothing about the backends and cannot forge a value
+// for another one.
+type StickySessions struct {
+	cookieName string
+	secret     []byte
+	maxAge     int
+}
+
+// NewStickySessions creates the affinity manager.
+// Without a configured secret a random one is generated, which means
+// existing cookies stop matching after a restart.
+func NewStickySessions(config StickyConfig) *StickySessions {
+	cookieName := config.CookieName
+	if cookieName == "" {
+		cookieName = defaultStickyCookie
+	}
+
+	secret := []byte(config.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		log.Printf("Sticky sessions have no secret configured, affinity will reset on restart")
+	}
+
+	return &StickySessions{
+		cookieName: cookieName,
+		secret:     secret,
+		maxAge:     config.MaxAge,
+	}
+}
+
+// Backend returns the backend identified by the affinity cookie,
+// or nil if there is none, it was removed or it is no longer available
+func (s *StickySessions) Backend(r *http.Request, backends []*Backend) *Backend {
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil {
+		return nil
+	}
+	id, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(id) != stickyIDSize {
+		return nil
+	}
+
+	for _, backend := range backends {
+		if hmac.Equal(id, s.id(backend)) {
+			if isCandidate(r, backend) {
+				return backend
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Pin adds an affinity cookie for the backend to the response headers
+// unless the request already carries one for it
+func (s *StickySessions) Pin(header http.Header, r *http.Request, backend *Backend) {
+	value := base64.RawURLEncoding.EncodeToString(s.id(backend))
+	if cookie, err := r.Cookie(s.cookieName); err == nil && cookie.Value == value {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     s.cookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   s.maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	header.Add("Set-Cookie", cookie.String())
+}
+
+// id derives the backend's opaque cookie value from its URL
+func (s *StickySessions) id(backend *Backend) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(backend.URL.String()))
+	return h.Sum(nil)[:stickyIDSize]
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// namedBackend starts a backend that answers with its name and status
+func namedBackend(t *testing.T, name string, status int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", name)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func stickyRequest(pool *Pool, cookie *http.Cookie) *http.Response {
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func affinityCookie(res *http.Response) *http.Cookie {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == defaultStickyCookie {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestStickySessions(t *testing.T) {
+	a := namedBackend(t, "a", http.StatusOK)
+	b := namedBackend(t, "b", http.StatusOK)
+	pool, err := NewPool("default", PoolConfig{
+		Algorithm: "round-robin",
+		Sticky:    StickyConfig{Enabled: true, Secret: "secret"},
+		Backends:  []BackendConfig{{URL: a.URL}, {URL: b.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := stickyRequest(pool, nil)
+	cookie := affinityCookie(res)
+	if cookie == nil {
+		t.Fatal("first response carries no affinity cookie")
+	}
+	pinned := res.Header.Get("X-Backend")
+
+	// The cookie must not reveal the backend address
+	raw, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+	for _, leak := range []string{a.URL, b.URL, "127.0.0.1"} {
+		if strings.Contains(cookie.Value, leak) || strings.Contains(string(raw), leak) {
+			t.Fatalf("cookie %q reveals %s", cookie.Value, leak)
+		}
+	}
+
+	for range 4 {
+		res := stickyRequest(pool, cookie)
+		if got := res.Header.Get("X-Backend"); got != pinned {
+			t.Fatalf("request served by %s, want pinned backend %s", got, pinned)
+		}
+		if affinityCookie(res) != nil {
+			t.Error("cookie reissued although the request already carries it")
+		}
+	}
+
+	// Tampered cookies are ignored and replaced
+	tampered := &http.Cookie{Name: defaultStickyCookie, Value: base64.RawURLEncoding.EncodeToString(make([]byte, stickyIDSize))}
+	if res := stickyRequest(pool, tampered); affinityCookie(res) == nil {
+		t.Error("tampered cookie was not replaced")
+	}
+
+	// A cookie for a backend that went down is replaced
+	urls := map[string]string{"a": a.URL, "b": b.URL}
+	for _, backend := range pool.GetBackends() {
+		if backend.URL.String() == urls[pinned] {
+			backend.SetAlive(false)
+		}
+	}
+	res = stickyRequest(pool, cookie)
+	if res.Header.Get("X-Backend") == pinned {
+		t.Fatal("request went to a backend that is down")
+	}
+	if replaced := affinityCookie(res); replaced == nil || replaced.Value == cookie.Value {
+		t.Error("cookie for a backend that is down was not replaced")
+	}
+}
+
+func TestStickySessionsPinOnlySuccess(t *testing.T) {
+	failing := namedBackend(t, "failing", http.StatusBadGateway)
+	pool, err := NewPool("default", PoolConfig{
+		Sticky:   StickyConfig{Enabled: true},
+		Backends: []BackendConfig{{URL: failing.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := stickyRequest(pool, nil)
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", res.StatusCode)
+	}
+	if affinityCookie(res) != nil {
+		t.Error("a 502 response pinned the client")
+	}
+
+	// Connection failures must not pin either
+	failing.Close()
+	res = stickyRequest(pool, nil)
+	if affinityCookie(res) != nil {
+		t.Error("a failed connection pinned the client")
+	}
+}
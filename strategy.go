@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Algorithm names accepted by the "algorithm" configuration field
+const (
+	AlgorithmSmart            = "smart"
+	AlgorithmRoundRobin       = "round-robin"
+	AlgorithmLeastConnections = "least-connections"
+	AlgorithmRandom           = "random"
+	AlgorithmConsistentHash   = "consistent-hash"
+	AlgorithmP2C              = "p2c"
+)
+
+// Strategy picks the backend that should serve a request.
+// Implementations must be safe for concurrent use and return nil
+// when none of the given backends is available.
+type Strategy interface {
+	Next(backends []*Backend, r *http.Request) *Backend
+}
+
+// NewStrategy returns the strategy for the given algorithm name.
+// An empty name selects the smart scheduler.
+func NewStrategy(algorithm string, hash HashConfig) (Strategy, error) {
+	switch algorithm {
+	case "", AlgorithmSmart:
+		return &SmartStrategy{}, nil
+	case AlgorithmRoundRobin:
+		return &RoundRobinStrategy{}, nil
+	case AlgorithmLeastConnections:
+		return &LeastConnectionsStrategy{}, nil
+	case AlgorithmRandom:
+		return &RandomStrategy{}, nil
+	case AlgorithmConsistentHash:
+		return NewConsistentHashStrategy(hash)
+	case AlgorithmP2C:
+		return &P2CStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm: %s", algorithm)
+	}
+}
+
+type excludedKey struct{}
+
+// withExcluded attaches a set of backends the scheduler must skip,
+// so that a retried request lands on a different backend
+func withExcluded(r *http.Request, excluded map[*Backend]bool) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), excludedKey{}, excluded))
+}
+
+// isCandidate reports whether a strategy may pick the backend for the request
+func isCandidate(r *http.Request, b *Backend) bool {
+	if r != nil {
+		if excluded, ok := r.Context().Value(excludedKey{}).(map[*Backend]bool); ok && excluded[b] {
+			return false
+		}
+	}
+	return b.IsAvailable()
+}
+
+// algorithmName returns the display name of an algorithm, resolving the default
+func algorithmName(algorithm string) string {
+	if algorithm == "" {
+		return AlgorithmSmart
+	}
+	return algorithm
+}
+
+/*
+ * @ SmartStrategy is the time-quanta-based scheduler
+ * score = ((time_quanta * (1 + connections)) + avg_latency) / weight
+ * backends within 20% of the best score are served round-robin
+ */
+type SmartStrategy struct {
+	current uint64
+}
+
+// Next returns the available backend with the lowest smart score
+func (s *SmartStrategy) Next(backends []*Backend, r *http.Request) *Backend {
+	// Find backends with the smallest score
+	// Include backends within 20% of the best score for fair distribution
+	var bestBackends []*Backend
+	var bestScore float64 = -1
+
+	scores := make([]float64, len(backends))
+	for i, backend := range backends {
+		if !isCandidate(r, backend) {
+			continue
+		}
+
+		// Calculate score: lower is better
+		// Score = ((time_quanta * (1 + connections)) + avg_latency) / weight
+		timeQuanta := float64(backend.GetTimeQuanta().Nanoseconds())
+		connections := float64(backend.GetActiveConnections())
+		avgLatency := float64(backend.GetAvgLatency().Nanoseconds())
+		weight := float64(backend.GetWeight())
+
+		scores[i] = ((timeQuanta * (1 + connections)) + avgLatency) / weight
+
+		if bestScore == -1 || scores[i] < bestScore {
+			bestScore = scores[i]
+		}
+	}
+
+	if bestScore == -1 {
+		return nil
+	}
+
+	// Collect all backends within 20% of the best score
+	threshold := bestScore * 1.2
+	for i, backend := range backends {
+		if isCandidate(r, backend) && scores[i] <= threshold {
+			bestBackends = append(bestBackends, backend)
+		}
+	}
+
+	// If we have backends with the same best score, use round-robin among them
+	if len(bestBackends) == 0 {
+		return nil
+	}
+	idx := atomic.AddUint64(&s.current, 1) % uint64(len(bestBackends))
+	return bestBackends[idx]
+}
+
+/*
+ * @ RoundRobinStrategy is nginx-style smooth weighted round-robin
+ * every pick adds each backend's weight to its current weight,
+ * selects the largest and subtracts the total from the winner,
+ * so a 3:1 split is served as a,a,b,a rather than a,a,a,b
+ */
+type RoundRobinStrategy struct {
+	mu sync.Mutex
+}
+
+// Next returns the next available backend in weighted rotation
+func (s *RoundRobinStrategy) Next(backends []*Backend, r *http.Request) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var best *Backend
+	var total int64
+	for _, backend := range backends {
+		if !isCandidate(r, backend) {
+			continue
+		}
+		weight := int64(backend.GetWeight())
+		backend.currentWeight += weight
+		total += weight
+		if best == nil || backend.currentWeight > best.currentWeight {
+			best = backend
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// LeastConnectionsStrategy picks the available backend with the fewest active
+// connections relative to its weight
+type LeastConnectionsStrategy struct {
+	current uint64
+}
+
+// Next returns the least loaded available backend, breaking ties round-robin
+func (s *LeastConnectionsStrategy) Next(backends []*Backend, r *http.Request) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	var best *Backend
+	var bestLoad float64
+	offset := atomic.AddUint64(&s.current, 1)
+	for i := 0; i < len(backends); i++ {
+		backend := backends[(offset+uint64(i))%uint64(len(backends))]
+		if !isCandidate(r, backend) {
+			continue
+		}
+		load := float64(backend.GetActiveConnections()) / float64(backend.GetWeight())
+		if best == nil || load < bestLoad {
+			best = backend
+			bestLoad = load
+		}
+	}
+	return best
+}
+
+// RandomStrategy picks an available backend at random, proportionally to its weight
+type RandomStrategy struct{}
+
+// Next returns a weighted random available backend
+func (s *RandomStrategy) Next(backends []*Backend, r *http.Request) *Backend {
+	alive := make([]*Backend, 0, len(backends))
+	total := 0
+	for _, backend := range backends {
+		if isCandidate(r, backend) {
+			alive = append(alive, backend)
+			total += backend.GetWeight()
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+
+	n := rand.IntN(total)
+	for _, backend := range alive {
+		n -= backend.GetWeight()
+		if n < 0 {
+			return backend
+		}
+	}
+	return alive[len(alive)-1]
+}
+
+// p2cPenalty is the cost assumed for a busy backend with no latency samples yet
+const p2cPenalty = float64(time.Second)
+
+// p2cAttempts is how many random pairs are drawn before falling back to a scan
+const p2cAttempts = 3
+
+/*
+ * @ P2CStrategy is power-of-two-choices with peak-EWMA latency
+ * two available backends are sampled at random and the one with the
+ * lower peak_ewma * (in_flight + 1) / weight wins, giving O(1)
+ * selection that still steers traffic away from slow nodes
+ */
+type P2CStrategy struct {
+	fallback RandomStrategy
+}
+
+// Next returns the cheaper of two randomly sampled available backends
+func (s *P2CStrategy) Next(backends []*Backend, r *http.Request) *Backend {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	if n == 1 {
+		if isCandidate(r, backends[0]) {
+			return backends[0]
+		}
+		return nil
+	}
+
+	for attempt := 0; attempt < p2cAttempts; attempt++ {
+		i := rand.IntN(n)
+		j := rand.IntN(n - 1)
+		if j >= i {
+			j++
+		}
+
+		a, b := backends[i], backends[j]
+		aAlive, bAlive := isCandidate(r, a), isCandidate(r, b)
+		switch {
+		case aAlive && bAlive:
+			if p2cCost(b) < p2cCost(a) {
+				return b
+			}
+			return a
+		case aAlive:
+			return a
+		case bAlive:
+			return b
+		}
+	}
+
+	// Most of the pool is down, scan for whatever is left
+	return s.fallback.Next(backends, r)
+}
+
+// p2cCost scores a backend for P2C: lower is better
+func p2cCost(b *Backend) float64 {
+	ewma, inFlight, weight := b.GetLoad()
+	latency := float64(ewma)
+	if latency == 0 && inFlight > 0 {
+		latency = p2cPenalty
+	}
+	return latency * float64(inFlight+1) / float64(weight)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackends creates one backend per weight, named a, b, c, ...
+func testBackends(t *testing.T, weights ...int) []*Backend {
+	t.Helper()
+	backends := make([]*Backend, len(weights))
+	for i, weight := range weights {
+		backend, err := NewBackend(BackendConfig{URL: fmt.Sprintf("http://%c.test:8080", 'a'+i), Weight: weight})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[i] = backend
+	}
+	return backends
+}
+
+// picks runs n selections and returns the hosts picked, "-" for none
+func picks(s Strategy, backends []*Backend, n int) string {
+	var seq []byte
+	r := httptest.NewRequest("GET", "/", nil)
+	for range n {
+		if backend := s.Next(backends, r); backend != nil {
+			seq = append(seq, backend.URL.Hostname()[0])
+		} else {
+			seq = append(seq, '-')
+		}
+	}
+	return string(seq)
+}
+
+func TestNewStrategy(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      Strategy
+	}{
+		{"", &SmartStrategy{}},
+		{AlgorithmSmart, &SmartStrategy{}},
+		{AlgorithmRoundRobin, &RoundRobinStrategy{}},
+		{AlgorithmLeastConnections, &LeastConnectionsStrategy{}},
+		{AlgorithmRandom, &RandomStrategy{}},
+		{AlgorithmConsistentHash, &ConsistentHashStrategy{}},
+		{AlgorithmP2C, &P2CStrategy{}},
+	}
+	for _, tt := range tests {
+		s, err := NewStrategy(tt.algorithm, HashConfig{})
+		if err != nil {
+			t.Errorf("%q: %v", tt.algorithm, err)
+			continue
+		}
+		if reflect.TypeOf(s) != reflect.TypeOf(tt.want) {
+			t.Errorf("%q: got %T, want %T", tt.algorithm, s, tt.want)
+		}
+	}
+	if _, err := NewStrategy("fastest", HashConfig{}); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
+
+func TestStrategiesSkipUnavailableBackends(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmSmart, AlgorithmRoundRobin, AlgorithmLeastConnections, AlgorithmRandom, AlgorithmConsistentHash, AlgorithmP2C} {
+		t.Run(algorithm, func(t *testing.T) {
+			s, _ := NewStrategy(algorithm, HashConfig{})
+			backends := testBackends(t, 1, 1, 1)
+			backends[0].SetAlive(false)
+			backends[2].EjectedUntil = time.Now().Add(time.Minute)
+			if got := picks(s, backends, 20); got != "bbbbbbbbbbbbbbbbbbbb" {
+				t.Errorf("picks = %s, want only b", got)
+			}
+
+			// Backends already tried by a retry are skipped too
+			r := withExcluded(httptest.NewRequest("GET", "/", nil), map[*Backend]bool{backends[1]: true})
+			if backend := s.Next(backends, r); backend != nil {
+				t.Errorf("picked %s, want none", backend.URL)
+			}
+			if backend := s.Next(nil, r); backend != nil {
+				t.Errorf("picked %s from an empty pool", backend.URL)
+			}
+		})
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	s := &RoundRobinStrategy{}
+	backends := testBackends(t, 1, 1, 1)
+	if got := picks(s, backends, 6); got != "abcabc" {
+		t.Errorf("picks = %s, want abcabc", got)
+	}
+
+	backends[1].SetAlive(false)
+	if got := picks(s, backends, 4); got != "acac" {
+		t.Errorf("picks with b down = %s, want acac", got)
+	}
+}
+
+func TestRoundRobinStrategyIsSmooth(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    string
+	}{
+		// The sequence nginx documents for weights 5, 1 and 1
+		{[]int{5, 1, 1}, "aabacaa" + "aabacaa"},
+		{[]int{3, 1}, "aaba" + "aaba"},
+		{[]int{2, 2, 1}, "abcab" + "abcab"},
+	}
+	for _, tt := range tests {
+		s := &RoundRobinStrategy{}
+		if got := picks(s, testBackends(t, tt.weights...), len(tt.want)); got != tt.want {
+			t.Errorf("weights %v: picks = %s, want %s", tt.weights, got, tt.want)
+		}
+	}
+
+	// A backend coming back joins the rotation without a burst
+	s := &RoundRobinStrategy{}
+	backends := testBackends(t, 5, 1, 1)
+	backends[0].SetAlive(false)
+	picks(s, backends, 5)
+	backends[0].SetAlive(true)
+	got := picks(s, backends, 7)
+	if strings.Count(got, "a") != 5 || strings.Count(got, "b") != 1 || strings.Contains(got, "aaa") {
+		t.Errorf("picks after recovery = %s, want a smooth 5:1:1 cycle", got)
+	}
+}
+
+func TestLeastConnectionsStrategy(t *testing.T) {
+	s := &LeastConnectionsStrategy{}
+	backends := testBackends(t, 1, 1, 4)
+	for range 3 {
+		backends[0].IncrementConnections()
+	}
+	backends[1].IncrementConnections()
+	for range 2 {
+		backends[2].IncrementConnections()
+	}
+
+	// Loads are 3, 1 and 2/4
+	if got := picks(s, backends, 3); got != "ccc" {
+		t.Errorf("picks = %s, want ccc", got)
+	}
+	for range 3 {
+		backends[2].IncrementConnections()
+	}
+	// Loads are 3, 1 and 5/4
+	if got := picks(s, backends, 3); got != "bbb" {
+		t.Errorf("picks = %s, want bbb", got)
+	}
+
+	// Ties rotate instead of always favouring the first backend
+	seen := make(map[byte]bool)
+	for _, c := range []byte(picks(s, testBackends(t, 1, 1, 1), 3)) {
+		seen[c] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("idle backends picked %d distinct times, want all 3", len(seen))
+	}
+}
+
+func TestRandomStrategyFollowsWeights(t *testing.T) {
+	s := &RandomStrategy{}
+	backends := testBackends(t, 9, 1)
+	counts := make(map[rune]int)
+	for _, c := range picks(s, backends, 10000) {
+		counts[c]++
+	}
+	if counts['a'] < 8500 || counts['a'] > 9500 {
+		t.Errorf("weight 9 of 10 got %d of 10000 picks", counts['a'])
+	}
+}
+
+func TestSmartStrategy(t *testing.T) {
+	s := &SmartStrategy{}
+	backends := testBackends(t, 1, 1, 1)
+	// Unmeasured backends all score zero and share the traffic
+	if got := picks(s, backends, 3); got != "bca" {
+		t.Errorf("picks = %s, want each idle backend in turn", got)
+	}
+
+	// Scores are 20ms, 200ms and 22ms: c is within 20% of a, b is not
+	backends[0].AddRequest(10 * time.Millisecond)
+	backends[1].AddRequest(100 * time.Millisecond)
+	backends[2].AddRequest(11 * time.Millisecond)
+	got := picks(s, backends, 4)
+	if got != "acac" && got != "caca" {
+		t.Errorf("picks = %s, want a and c in turn", got)
+	}
+
+	// Connections multiply the time quanta: a scores 10ms * 5 + 10ms
+	for range 4 {
+		backends[0].IncrementConnections()
+	}
+	if got := picks(s, backends, 3); got != "ccc" {
+		t.Errorf("picks with a busy = %s, want ccc", got)
+	}
+
+	// Weight divides the score: b scores 200ms / 10
+	backends[1].Weight = 10
+	got = picks(s, backends, 4)
+	if got != "bcbc" && got != "cbcb" {
+		t.Errorf("picks with b weighted = %s, want b and c in turn", got)
+	}
+}
+
+func TestConsistentHashStrategyIsSticky(t *testing.T) {
+	s, err := NewConsistentHashStrategy(HashConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := testBackends(t, 1, 1, 1)
+
+	seen := make(map[*Backend]bool)
+	for i := range 50 {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+		first := s.Next(backends, r)
+		for range 3 {
+			if backend := s.Next(backends, r); backend != first {
+				t.Fatalf("client %s moved from %s to %s", r.RemoteAddr, first.URL, backend.URL)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("50 clients spread over %d backends, want 3", len(seen))
+	}
+}
+
+func TestP2CCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		ewma     time.Duration
+		inFlight int
+		weight   int
+		want     float64
+	}{
+		{name: "idle and unmeasured", weight: 1, want: 0},
+		{name: "busy and unmeasured", inFlight: 2, weight: 1, want: 3 * p2cPenalty},
+		{name: "idle", ewma: 10 * time.Millisecond, weight: 1, want: float64(10 * time.Millisecond)},
+		{name: "in flight", ewma: 10 * time.Millisecond, inFlight: 3, weight: 1, want: float64(40 * time.Millisecond)},
+		{name: "weighted", ewma: 10 * time.Millisecond, inFlight: 3, weight: 4, want: float64(10 * time.Millisecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := testBackends(t, tt.weight)[0]
+			backend.PeakEWMA = tt.ewma
+			for range tt.inFlight {
+				backend.IncrementConnections()
+			}
+			if got := p2cCost(backend); got != tt.want {
+				t.Errorf("cost = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	backend := testBackends(t, 1)[0]
+	backend.AddRequest(10 * time.Millisecond)
+	if backend.PeakEWMA != 10*time.Millisecond {
+		t.Fatalf("first sample = %v, want 10ms", backend.PeakEWMA)
+	}
+
+	// Spikes are taken at once
+	backend.AddRequest(200 * time.Millisecond)
+	if backend.PeakEWMA != 200*time.Millisecond {
+		t.Fatalf("after a spike = %v, want 200ms", backend.PeakEWMA)
+	}
+
+	// A fast sample right after the spike barely moves the estimate
+	backend.AddRequest(10 * time.Millisecond)
+	if backend.PeakEWMA < 190*time.Millisecond {
+		t.Errorf("right after the spike = %v, want it remembered", backend.PeakEWMA)
+	}
+
+	// After several decay periods the spike is forgotten
+	backend.ewmaStamp = time.Now().Add(-5 * peakEWMADecay)
+	backend.AddRequest(10 * time.Millisecond)
+	if backend.PeakEWMA > 12*time.Millisecond {
+		t.Errorf("long after the spike = %v, want about 10ms", backend.PeakEWMA)
+	}
+}
+
+func TestP2CStrategy(t *testing.T) {
+	s := &P2CStrategy{}
+
+	// With two backends both are always sampled, so the cheaper one wins
+	backends := testBackends(t, 1, 1)
+	backends[0].AddRequest(50 * time.Millisecond)
+	backends[1].AddRequest(10 * time.Millisecond)
+	if got := picks(s, backends, 20); got != strings.Repeat("b", 20) {
+		t.Errorf("picks = %s, want only the faster b", got)
+	}
+	// Requests in flight make b cost 10ms * 6, more than a
+	for range 5 {
+		backends[1].IncrementConnections()
+	}
+	if got := picks(s, backends, 20); got != strings.Repeat("a", 20) {
+		t.Errorf("picks with b busy = %s, want only a", got)
+	}
+
+	// The most expensive backend loses every pair it is drawn in
+	backends = testBackends(t, 1, 1, 1, 1)
+	for i, latency := range []time.Duration{10, 20, 30, 500} {
+		backends[i].AddRequest(latency * time.Millisecond)
+	}
+	got := picks(s, backends, 1000)
+	if strings.Contains(got, "d") {
+		t.Error("slowest backend was picked")
+	}
+	if strings.Count(got, "a") < strings.Count(got, "c") {
+		t.Errorf("fastest backend picked %d times, less than the slower c's %d", strings.Count(got, "a"), strings.Count(got, "c"))
+	}
+
+	// With most of the pool down the fallback scan still finds a backend
+	backends = testBackends(t, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
+	for _, backend := range backends[:9] {
+		backend.SetAlive(false)
+	}
+	if got := picks(s, backends, 50); got != strings.Repeat("j", 50) {
+		t.Errorf("picks = %s, want only the last available backend", got)
+	}
+}
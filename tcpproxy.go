@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTCPConnectTimeout = 5 * time.Second
+	tcpBufferSize            = 32 * 1024
+)
+
+/*
+ * @ TCPProxy is a layer-4 listener that splices client connections
+ * to the backends of a pool. Backends are chosen by the pool's
+ * strategy and share its health checks, outlier detection and
+ * circuit breakers with HTTP traffic. With SNI routes the pool is
+ * picked from the server name of the TLS ClientHello, and the TLS
+ * session is passed through to the backend untouched
+ */
+type TCPProxy struct {
+	name           string
+	addr           string
+	pool           *Pool
+	sni            *hostTable[*Pool]
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+
+	mu     sync.Mutex
+	conns  map[*tcpConn]struct{}
+	nextID uint64
+}
+
+// tcpConn is an active client connection and its byte counters
+type tcpConn struct {
+	id       uint64
+	client   net.Conn
+	upstream net.Conn
+	pool     *Pool
+	backend  *Backend
+	started  time.Time
+	bytesIn  atomic.Int64 // client to backend
+	bytesOut atomic.Int64 // backend to client
+	active   atomic.Int64 // unix nanoseconds of the last transfer
+}
+
+// ConnectionMetrics describes an active layer-4 connection
+type ConnectionMetrics struct {
+	ID       uint64        `json:"id"`
+	Protocol string        `json:"protocol"`
+	Listener string        `json:"listener"`
+	Pool     string        `json:"pool"`
+	Client   string        `json:"client"`
+	Backend  string        `json:"backend"`
+	BytesIn  int64         `json:"bytes_in"`
+	BytesOut int64         `json:"bytes_out"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// NewTCPProxy creates a TCP listener for the configured pools
+func NewTCPProxy(config TCPListenerConfig, pools map[string]*Pool) (*TCPProxy, error) {
+	name := config.Name
+	if name == "" {
+		name = config.Listen
+	}
+
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		return nil, fmt.Errorf("tcp listener %s: invalid listen address: %w", name, err)
+	}
+
+	// lookup resolves a pool name and checks its backends can be dialed
+	lookup := func(poolName string) (*Pool, error) {
+		pool, ok := pools[poolName]
+		if !ok {
+			return nil, fmt.Errorf("tcp listener %s references unknown pool: %s", name, poolName)
+		}
+		if err := pool.serveListener("tcp listener " + name); err != nil {
+			return nil, err
+		}
+		return pool, nil
+	}
+
+	var pool *Pool
+	if config.Pool != "" {
+		p, err := lookup(config.Pool)
+		if err != nil {
+			return nil, err
+		}
+		pool = p
+	}
+
+	var sni *hostTable[*Pool]
+	if len(config.SNI) > 0 {
+		sni = &hostTable[*Pool]{}
+		for _, route := range config.SNI {
+			p, err := lookup(route.Pool)
+			if err != nil {
+				return nil, err
+			}
+			for _, host := range route.Hosts {
+				if err := sni.add(host, p); err != nil {
+					return nil, fmt.Errorf("tcp listener %s: %w", name, err)
+				}
+			}
+		}
+	} else if pool == nil {
+		return nil, fmt.Errorf("tcp listener %s needs a pool or sni routes", name)
+	}
+
+	connectTimeout := time.Duration(config.ConnectTimeout) * time.Second
+	if connectTimeout <= 0 {
+		connectTimeout = defaultTCPConnectTimeout
+	}
+
+	return &TCPProxy{
+		name:           name,
+		addr:           config.Listen,
+		pool:           pool,
+		sni:            sni,
+		connectTimeout: connectTimeout,
+		idleTimeout:    time.Duration(config.IdleTimeout) * time.Second,
+		conns:          make(map[*tcpConn]struct{}),
+	}, nil
+}
+
+// Name returns the listener name
+func (t *TCPProxy) Name() string {
+	return t.name
+}
+
+// Addr returns the configured listen address
+func (t *TCPProxy) Addr() string {
+	return t.addr
+}
+
+// Serve accepts connections until the context is cancelled
+func (t *TCPProxy) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go t.handle(conn)
+	}
+}
+
+// handle connects the client to a backend and copies data both ways
+func (t *TCPProxy) handle(client net.Conn) {
+	defer client.Close()
+
+	c := &tcpConn{client: client, pool: t.pool, started: time.Now()}
+	if t.sni != nil {
+		serverName, peeked, err := peekServerName(client, t.connectTimeout)
+		if err != nil {
+			log.Printf("TLS passthrough from %s: %v", client.RemoteAddr(), err)
+			return
+		}
+		c.client = peeked
+		if pool := t.sni.match(strings.ToLower(serverName)); pool != nil {
+			c.pool = pool
+		}
+		if c.pool == nil {
+			log.Printf("No pool for server name %q from %s", serverName, client.RemoteAddr())
+			return
+		}
+	}
+	r := tcpRequest(client)
+
+	// Connection failures are retried on another backend when the pool's
+	// retry policy allows it; nothing has been sent to the backend yet
+	tried := make(map[*Backend]bool)
+	r = withExcluded(r, tried)
+
+	attempts := 0
+	for {
+		backend := c.pool.GetNextBackend(r)
+		if backend == nil {
+			log.Printf("No healthy backends available in pool %s for %s", c.pool.Name(), client.RemoteAddr())
+			return
+		}
+		tried[backend] = true
+
+		generation, ok := backend.Admit()
+		if !ok {
+			continue
+		}
+		attempts++
+
+		start := time.Now()
+		upstream, err := t.dial(r.Context(), backend)
+		c.pool.observe(backend, generation, err != nil, time.Since(start))
+		if err == nil {
+			c.backend = backend
+			c.upstream = upstream
+			break
+		}
+
+		log.Printf("TCP connect to %s failed: %v", backend.URL.Host, err)
+		policy := c.pool.retry
+		if policy == nil || attempts >= policy.maxAttempts || !policy.retryOnError(err) {
+			return
+		}
+		backend.AddRetry()
+	}
+	defer c.upstream.Close()
+
+	c.backend.IncrementConnections()
+	defer c.backend.DecrementConnections()
+
+	t.track(c)
+	defer t.untrack(c)
+
+	c.touch()
+	done := make(chan struct{}, 2)
+	go func() {
+		t.pipe(c, c.upstream, c.client, &c.bytesIn)
+		done <- struct{}{}
+	}()
+	go func() {
+		t.pipe(c, c.client, c.upstream, &c.bytesOut)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	c.backend.AddBytes(c.bytesIn.Load(), c.bytesOut.Load())
+	log.Printf("Closed TCP connection %s -> %s (in %d bytes, out %d bytes, %v)",
+		client.RemoteAddr(), c.backend.URL.Host, c.bytesIn.Load(), c.bytesOut.Load(), time.Since(c.started))
+}
+
+// dial opens the upstream connection, sending a PROXY header if the pool requires one
+func (t *TCPProxy) dial(ctx context.Context, backend *Backend) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.connectTimeout)
+	defer cancel()
+	return backend.dialContext(ctx, "tcp", backend.URL.Host)
+}
+
+// pipe copies src to dst until EOF, an error or the idle timeout. The
+// timeout only fires when neither direction has moved data.
+func (t *TCPProxy) pipe(c *tcpConn, dst, src net.Conn, counter *atomic.Int64) {
+	buf := make([]byte, tcpBufferSize)
+	for {
+		if t.idleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(t.idleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			c.touch()
+			counter.Add(int64(n))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				c.close()
+				return
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && c.idle() < t.idleTimeout {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				// Half-close so the other side sees EOF but can still reply
+				if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+					return
+				}
+			}
+			c.close()
+			return
+		}
+	}
+}
+
+func (c *tcpConn) touch() {
+	c.active.Store(time.Now().UnixNano())
+}
+
+func (c *tcpConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.active.Load()))
+}
+
+func (c *tcpConn) close() {
+	c.client.Close()
+	c.upstream.Close()
+}
+
+func (t *TCPProxy) track(c *tcpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	c.id = t.nextID
+	t.conns[c] = struct{}{}
+}
+
+func (t *TCPProxy) untrack(c *tcpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// GetConnections returns metrics for the active connections
+func (t *TCPProxy) GetConnections() []ConnectionMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := make([]ConnectionMetrics, 0, len(t.conns))
+	for c := range t.conns {
+		metrics = append(metrics, ConnectionMetrics{
+			ID:       c.id,
+			Protocol: "tcp",
+			Listener: t.name,
+			Pool:     c.pool.Name(),
+			Client:   c.client.RemoteAddr().String(),
+			Backend:  c.backend.URL.String(),
+			BytesIn:  c.bytesIn.Load(),
+			BytesOut: c.bytesOut.Load(),
+			Started:  c.started,
+			Duration: time.Since(c.started),
+		})
+	}
+	return metrics
+}
+
+// tcpRequest presents a connection to the request-based scheduling
+// machinery: strategies, hashing and exclusions only need the client
+// address and a context, and PROXY headers need the listener address
+func tcpRequest(conn net.Conn) *http.Request {
+	forwarded := &forwardedInfo{}
+	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	forwarded.clientIP = host
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		forwarded.clientPort = uint16(p)
+	}
+
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, conn.LocalAddr())
+	ctx = context.WithValue(ctx, requestInfoKey{}, &requestInfo{start: time.Now(), forwarded: forwarded})
+	return (&http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Path: "/"},
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}).WithContext(ctx)
+}
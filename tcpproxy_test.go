@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// namedTCPBackend starts a TCP server that checks it received the expected
+// bytes, answers with its name and closes
+func namedTCPBackend(t *testing.T, name string, expect []byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				got := make([]byte, len(expect))
+				if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, expect) {
+					t.Errorf("backend %s did not receive the client's bytes intact", name)
+					return
+				}
+				io.WriteString(conn, name)
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+// startTCPProxy serves a TCP listener over the pools and returns its address
+func startTCPProxy(t *testing.T, config TCPListenerConfig, pools map[string]*Pool) string {
+	t.Helper()
+	proxy, err := NewTCPProxy(config, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		proxy.Serve(ctx, ln)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+func TestTCPProxySNIRouting(t *testing.T) {
+	hellos := map[string][]byte{
+		"vault.example.com": clientHello(t, "vault.example.com"),
+		"a.k8s.example.com": clientHello(t, "a.k8s.example.com"),
+		"www.example.com":   clientHello(t, "www.example.com"),
+		"":                  clientHello(t, ""),
+	}
+
+	pools := make(map[string]*Pool)
+	for name, serverName := range map[string]string{"vault": "vault.example.com", "ingress": "a.k8s.example.com", "web": "www.example.com"} {
+		pool, err := NewPool(name, PoolConfig{Backends: []BackendConfig{{URL: namedTCPBackend(t, name, hellos[serverName])}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[name] = pool
+	}
+	// Connections without a server name fall back like unmatched ones
+	fallback, err := NewPool("fallback", PoolConfig{Backends: []BackendConfig{{URL: namedTCPBackend(t, "fallback", hellos[""])}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools["fallback"] = fallback
+
+	sni := []FrontendConfig{
+		{Hosts: []string{"*.example.com"}, Pool: "web"},
+		{Hosts: []string{"vault.example.com"}, Pool: "vault"},
+		{Hosts: []string{"*.k8s.example.com"}, Pool: "ingress"},
+	}
+	addr := startTCPProxy(t, TCPListenerConfig{Name: "tls", Listen: "127.0.0.1:0", SNI: sni, Pool: "fallback"}, pools)
+
+	dial := func(hello []byte) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(hello)
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+	for serverName, want := range map[string]string{
+		"vault.example.com": "vault",
+		"a.k8s.example.com": "ingress",
+		"www.example.com":   "web",
+		"":                  "fallback",
+	} {
+		if got := dial(hellos[serverName]); got != want {
+			t.Errorf("server name %q routed to %q, want %q", serverName, got, want)
+		}
+	}
+
+	// Without a fallback pool unmatched connections are closed
+	delete(pools, "fallback")
+	addr = startTCPProxy(t, TCPListenerConfig{Name: "tls", Listen: "127.0.0.1:0", SNI: sni}, pools)
+	if got := dial(clientHello(t, "other.test")); got != "" {
+		t.Errorf("unmatched server name routed to %q, want the connection closed", got)
+	}
+	if got := dial([]byte("GET / HTTP/1.1\r\n\r\n")); got != "" {
+		t.Errorf("plain text routed to %q, want the connection closed", got)
+	}
+}
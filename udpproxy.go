@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultUDPSessionTimeout = 30 * time.Second
+	maxDatagramSize          = 64 * 1024
+	// datagrams held per session while its backend is being resolved
+	maxPendingDatagrams = 32
+)
+
+/*
+ * @ UDPProxy forwards datagrams to the backends of a pool. Each client
+ * address gets a session bound to one backend, so replies find their
+ * way back and related datagrams (a DNS retry, a syslog stream) stay
+ * together. Sessions end after a period without traffic
+ */
+type UDPProxy struct {
+	name    string
+	addr    string
+	pool    *Pool
+	timeout time.Duration
+
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	nextID   uint64
+}
+
+// udpSession tracks one client address and its upstream socket
+type udpSession struct {
+	id       uint64
+	client   *net.UDPAddr
+	backend  *Backend
+	started  time.Time
+	bytesIn  atomic.Int64 // client to backend
+	bytesOut atomic.Int64 // backend to client
+	active   atomic.Int64 // unix nanoseconds of the last datagram
+	closed   sync.Once
+	// circuit breaker generation the session was admitted in
+	generation uint64
+
+	// upstream is nil until the backend has been resolved and dialed;
+	// datagrams arriving before that are queued in pending
+	mu       sync.Mutex
+	upstream *net.UDPConn
+	pending  [][]byte
+	done     bool
+}
+
+// NewUDPProxy creates a UDP listener for the given pool
+func NewUDPProxy(config UDPListenerConfig, pool *Pool) (*UDPProxy, error) {
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		return nil, fmt.Errorf("udp listener %s: invalid listen address: %w", config.Name, err)
+	}
+
+	name := config.Name
+	if name == "" {
+		name = config.Listen
+	}
+	if err := pool.serveListener("udp listener " + name); err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(config.SessionTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultUDPSessionTimeout
+	}
+
+	return &UDPProxy{
+		name:     name,
+		addr:     config.Listen,
+		pool:     pool,
+		timeout:  timeout,
+		sessions: make(map[string]*udpSession),
+	}, nil
+}
+
+// Name returns the listener name
+func (u *UDPProxy) Name() string {
+	return u.name
+}
+
+// Addr returns the configured listen address
+func (u *UDPProxy) Addr() string {
+	return u.addr
+}
+
+// Serve reads datagrams until the context is cancelled
+func (u *UDPProxy) Serve(ctx context.Context, conn *net.UDPConn) error {
+	u.conn = conn
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				u.closeAll()
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		session := u.session(client)
+		if session == nil {
+			continue
+		}
+		session.touch()
+		session.bytesIn.Add(int64(n))
+		if err := session.send(buf[:n]); err != nil {
+			// The session may have just idled out; the datagram is dropped like any lost packet
+			if errors.Is(err, net.ErrClosed) {
+				continue
+			}
+			log.Printf("UDP send to %s failed: %v", session.backend.URL.Host, err)
+			u.fail(session)
+		}
+	}
+}
+
+// session returns the client's session, starting a new one on a
+// freshly scheduled backend if there is none or its backend went away
+func (u *UDPProxy) session(client *net.UDPAddr) *udpSession {
+	key := client.String()
+
+	u.mu.Lock()
+	session, ok := u.sessions[key]
+	u.mu.Unlock()
+	if ok {
+		if session.backend.IsAvailable() {
+			return session
+		}
+		u.close(session)
+	}
+
+	r := udpRequest(client, u.conn.LocalAddr())
+	backend := u.pool.GetNextBackend(r)
+	if backend == nil {
+		log.Printf("No healthy backends available in pool %s for %s", u.pool.Name(), client)
+		return nil
+	}
+	generation, ok := backend.Admit()
+	if !ok {
+		return nil
+	}
+
+	session = &udpSession{client: client, backend: backend, started: time.Now(), generation: generation}
+	backend.IncrementConnections()
+
+	u.mu.Lock()
+	u.nextID++
+	session.id = u.nextID
+	u.sessions[key] = session
+	u.mu.Unlock()
+
+	// Resolving the backend may block on DNS, which must not hold up
+	// the read loop and with it every other client
+	go u.connect(session)
+	return session
+}
+
+// connect dials the session's backend, forwards the datagrams queued in
+// the meantime and then relays replies
+func (u *UDPProxy) connect(s *udpSession) {
+	raddr, err := net.ResolveUDPAddr("udp", s.backend.URL.Host)
+	var upstream *net.UDPConn
+	if err == nil {
+		upstream, err = net.DialUDP("udp", nil, raddr)
+	}
+	if err != nil {
+		log.Printf("UDP connect to %s failed: %v", s.backend.URL.Host, err)
+		u.fail(s)
+		return
+	}
+
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		upstream.Close()
+		return
+	}
+	s.upstream = upstream
+	for _, datagram := range s.pending {
+		if _, err := upstream.Write(datagram); err != nil {
+			break
+		}
+	}
+	s.pending = nil
+	s.mu.Unlock()
+
+	// Dialing UDP cannot detect a dead peer, so success waits for a reply
+	u.relay(s)
+}
+
+// send forwards a datagram to the backend, or queues a copy while the
+// session is still connecting
+func (s *udpSession) send(datagram []byte) error {
+	s.mu.Lock()
+	upstream := s.upstream
+	if upstream == nil {
+		if !s.done && len(s.pending) < maxPendingDatagrams {
+			s.pending = append(s.pending, bytes.Clone(datagram))
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	_, err := upstream.Write(datagram)
+	return err
+}
+
+// relay copies replies from the backend to the client until the session
+// idles out. The first reply marks the backend healthy, with the time it
+// took as the session's latency.
+func (u *UDPProxy) relay(s *udpSession) {
+	defer u.close(s)
+
+	answered := false
+	buf := make([]byte, maxDatagramSize)
+	for {
+		s.upstream.SetReadDeadline(time.Now().Add(u.timeout))
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if s.idle() < u.timeout {
+					continue
+				}
+				// One-way traffic like syslog never gets a reply; end a
+				// half-open breaker's trial without judging the backend
+				if !answered && s.backend.breaker != nil {
+					s.backend.breaker.Record(s.generation, false, 0)
+				}
+				return
+			}
+			// Typically ICMP port unreachable surfacing as a refused read
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("UDP receive from %s failed: %v", s.backend.URL.Host, err)
+				u.pool.observe(s.backend, s.generation, true, 0)
+			}
+			return
+		}
+
+		if !answered {
+			answered = true
+			u.pool.observe(s.backend, s.generation, false, time.Since(s.started))
+		}
+		s.touch()
+		s.bytesOut.Add(int64(n))
+		if _, err := u.conn.WriteToUDP(buf[:n], s.client); err != nil {
+			return
+		}
+	}
+}
+
+// fail records a backend error and drops the session
+func (u *UDPProxy) fail(s *udpSession) {
+	u.pool.observe(s.backend, s.generation, true, 0)
+	u.close(s)
+}
+
+// close ends a session and accounts its traffic to the backend
+func (u *UDPProxy) close(s *udpSession) {
+	s.closed.Do(func() {
+		u.mu.Lock()
+		if u.sessions[s.client.String()] == s {
+			delete(u.sessions, s.client.String())
+		}
+		u.mu.Unlock()
+
+		s.mu.Lock()
+		s.done = true
+		s.pending = nil
+		if s.upstream != nil {
+			s.upstream.Close()
+		}
+		s.mu.Unlock()
+
+		s.backend.DecrementConnections()
+		s.backend.AddBytes(s.bytesIn.Load(), s.bytesOut.Load())
+	})
+}
+
+func (u *UDPProxy) closeAll() {
+	u.mu.Lock()
+	sessions := make([]*udpSession, 0, len(u.sessions))
+	for _, s := range u.sessions {
+		sessions = append(sessions, s)
+	}
+	u.mu.Unlock()
+
+	for _, s := range sessions {
+		u.close(s)
+	}
+}
+
+func (s *udpSession) touch() {
+	s.active.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.active.Load()))
+}
+
+// GetConnections returns metrics for the active sessions
+func (u *UDPProxy) GetConnections() []ConnectionMetrics {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	metrics := make([]ConnectionMetrics, 0, len(u.sessions))
+	for _, s := range u.sessions {
+		metrics = append(metrics, ConnectionMetrics{
+			ID:       s.id,
+			Protocol: "udp",
+			Listener: u.name,
+			Pool:     u.pool.Name(),
+			Client:   s.client.String(),
+			Backend:  s.backend.URL.String(),
+			BytesIn:  s.bytesIn.Load(),
+			BytesOut: s.bytesOut.Load(),
+			Started:  s.started,
+			Duration: time.Since(s.started),
+		})
+	}
+	return metrics
+}
+
+// udpRequest presents a datagram's client to the request-based scheduler
+func udpRequest(client *net.UDPAddr, local net.Addr) *http.Request {
+	forwarded := &forwardedInfo{clientIP: client.IP.String(), clientPort: uint16(client.Port)}
+
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, local)
+	ctx = context.WithValue(ctx, requestInfoKey{}, &requestInfo{start: time.Now(), forwarded: forwarded})
+	return (&http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Path: "/"},
+		Header:     make(http.Header),
+		RemoteAddr: client.String(),
+	}).WithContext(ctx)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEcho starts a UDP server that echoes every datagram
+func udpEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// startUDPProxy serves a UDP listener for a pool of the given backends
+// and returns it with its address
+func startUDPProxy(t *testing.T, backends ...string) (*UDPProxy, *net.UDPAddr) {
+	t.Helper()
+	config := PoolConfig{}
+	for _, backend := range backends {
+		config.Backends = append(config.Backends, BackendConfig{URL: backend})
+	}
+	pool, err := NewPool("udp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewUDPProxy(UDPListenerConfig{Listen: "127.0.0.1:0", SessionTimeout: 5}, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		proxy.Serve(ctx, conn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return proxy, conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPProxyRelaysDatagrams(t *testing.T) {
+	echo := udpEcho(t)
+	proxy, addr := startUDPProxy(t, "udp://"+echo.LocalAddr().String())
+
+	for _, client := range []string{"first", "second"} {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		for i, message := range []string{client + " 1", client + " 2", client + " 3"} {
+			if _, err := conn.Write([]byte(message)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("%s datagram %d: %v", client, i, err)
+			}
+			if string(buf[:n]) != message {
+				t.Errorf("reply = %q, want %q", buf[:n], message)
+			}
+		}
+	}
+
+	if sessions := len(proxy.GetConnections()); sessions != 2 {
+		t.Errorf("%d sessions, want 2", sessions)
+	}
+}
+
+// Datagrams arriving while the backend is resolved are forwarded in order
+func TestUDPSessionQueuesUntilConnected(t *testing.T) {
+	echo := udpEcho(t)
+	pool, err := NewPool("udp", PoolConfig{Backends: []BackendConfig{{URL: "udp://" + echo.LocalAddr().String()}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewUDPProxy(UDPListenerConfig{Listen: "127.0.0.1:0"}, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replies leave through the listener socket, which is not read here
+	proxy.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.conn.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	backend := proxy.pool.GetBackends()[0]
+	session := &udpSession{client: client.LocalAddr().(*net.UDPAddr), backend: backend, started: time.Now()}
+	session.touch()
+	backend.IncrementConnections()
+	messages := []string{"one", "two", "three"}
+	for _, message := range messages {
+		if err := session.send([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go proxy.connect(session)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, message := range messages {
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != message {
+			t.Errorf("reply = %q, want %q", buf[:n], message)
+		}
+	}
+	proxy.close(session)
+}
+
+func TestUDPProxyUnresolvableBackend(t *testing.T) {
+	proxy, addr := startUDPProxy(t, "udp://backend.invalid:53")
+	backend := proxy.pool.GetBackends()[0]
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("query"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(proxy.GetConnections()) != 0 || backend.GetMetrics().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session for an unresolvable backend was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}